@@ -49,6 +49,11 @@ func (k *ArrayKeyring) Keys() ([]string, error) {
 	return keys, nil
 }
 
+// Close does nothing for the mock Keyring.
+func (k *ArrayKeyring) Close() error {
+	return nil
+}
+
 func (k *ArrayKeyring) GetMetadata(_ string) (Metadata, error) {
 	return Metadata{}, ErrMetadataNeedsCredentials
 }
@@ -10,6 +10,13 @@ import (
 )
 
 func main() {
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
 	serviceName := flag.String("service", "example", "The keyring service to use")
 	keyName := flag.String("key", "example", "The key to use")
 	backend := flag.String("backend", "", "A specific backend to use")
@@ -20,9 +27,18 @@ func main() {
 	actionListKeys := flag.Bool("list-keys", false, "Whether to list keys")
 	actionSetValue := flag.String("set", "", "The value to set")
 
+	actionAddRecipient := flag.String("add-recipient", "", "A recipient to add to the directory given by -recipients-dir")
+	actionRemoveRecipient := flag.String("remove-recipient", "", "A recipient to remove from the directory given by -recipients-dir")
+	actionReencrypt := flag.Bool("reencrypt", false, "Whether to re-encrypt the directory given by -recipients-dir")
+	recipientsDir := flag.String("recipients-dir", "", "The directory to manage recipients for")
+
 	// keychain
 	keychainName := flag.String("keychain", "login", "The keychain to search")
 
+	// file
+	fileDir := flag.String("file-dir", "", "The directory of the file backend")
+	fileIdentity := flag.String("file-identity", "", "The age identity file used to decrypt the file backend")
+
 	flag.Parse()
 
 	// Handle -list-backends
@@ -30,7 +46,7 @@ func main() {
 		for _, b := range keyring.AvailableBackends() {
 			fmt.Printf("%s\n", b)
 		}
-		os.Exit(0)
+		return nil
 	}
 
 	// Log to stderr
@@ -41,31 +57,44 @@ func main() {
 	var allowedBackends []keyring.BackendType
 	if *backend != "" {
 		if !hasBackend(*backend) {
-			log.Fatalf("Backend %q isn't available. Use -list-backends to see what is.", *backend)
+			return fmt.Errorf("Backend %q isn't available. Use -list-backends to see what is.", *backend)
 		}
 		allowedBackends = append(allowedBackends, keyring.BackendType(*backend))
 	} else {
 		allowedBackends = keyring.AvailableBackends()
 	}
 
-	ring, err := keyring.Open(keyring.Config{
-		ServiceName:     *serviceName,
-		AllowedBackends: allowedBackends,
-		KeychainName:    *keychainName,
-	})
-	if err != nil {
-		log.Fatal(err)
+	cfg := keyring.Config{
+		ServiceName:      *serviceName,
+		KeychainName:     *keychainName,
+		FileDir:          *fileDir,
+		FileIdentityFile: *fileIdentity,
+	}
+
+	// Try the backends one at a time, to know which one was opened
+	var ring keyring.Keyring
+	var opened keyring.BackendType
+	for _, b := range allowedBackends {
+		cfg.AllowedBackends = []keyring.BackendType{b}
+		if r, err := keyring.Open(cfg); err == nil {
+			ring, opened = r, b
+			break
+		}
+	}
+	if ring == nil {
+		return keyring.ErrNoAvailImpl
 	}
+	defer ring.Close()
 
 	switch {
 	case *actionListKeys:
 		if *debug {
 			log.Printf("Listing keys in service %q in backend %q",
-				*serviceName, allowedBackends[0])
+				*serviceName, opened)
 		}
 		keys, err := ring.Keys()
 		if err != nil {
-			log.Fatalf("Failed to list keys: %#v", err)
+			return fmt.Errorf("Failed to list keys: %#v", err)
 		}
 		for _, key := range keys {
 			fmt.Printf("%s\n", key)
@@ -74,28 +103,42 @@ func main() {
 	case *actionSetValue != "":
 		if *debug {
 			log.Printf("Setting key %q in service %q in backend %q",
-				*keyName, *serviceName, allowedBackends[0])
+				*keyName, *serviceName, opened)
 		}
-		err := ring.Set(keyring.Item{
+		return ring.Set(keyring.Item{
 			Key:  *keyName,
 			Data: []byte(*actionSetValue),
 		})
-		if err != nil {
-			log.Fatal(err)
+
+	case *actionAddRecipient != "", *actionRemoveRecipient != "", *actionReencrypt:
+		recipientRing, ok := ring.(keyring.RecipientKeyring)
+		if !ok {
+			return fmt.Errorf("Backend %q doesn't support recipients", opened)
+		}
+
+		switch {
+		case *actionAddRecipient != "":
+			return recipientRing.AddRecipients(*recipientsDir, *actionAddRecipient)
+		case *actionRemoveRecipient != "":
+			return recipientRing.RemoveRecipients(*recipientsDir, *actionRemoveRecipient)
+		default:
+			return recipientRing.Reencrypt(*recipientsDir)
 		}
 
 	default:
 		if *debug {
 			log.Printf("Getting key %q in service %q in backend %q",
-				*keyName, *serviceName, allowedBackends[0])
+				*keyName, *serviceName, opened)
 		}
 
 		i, err := ring.Get(*keyName)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		fmt.Printf("%s", i.Data)
 	}
+
+	return nil
 }
 
 func hasBackend(key string) bool {
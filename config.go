@@ -1,5 +1,7 @@
 package keyring
 
+import "time"
+
 // Config contains configuration for keyring.
 type Config struct {
 	// AllowedBackends is a whitelist of backend providers that can be used. Nil means all available.
@@ -26,24 +28,70 @@ type Config struct {
 	// FilePasswordFunc is a required function used to prompt the user for a password
 	FilePasswordFunc PromptFunc
 
+	// FilePasswordFile is an optional path to a keyfile holding the password, used instead of FilePasswordFunc
+	FilePasswordFile string
+
+	// FilePasswordCommand is an optional command whose output is the password, used instead of FilePasswordFunc
+	FilePasswordCommand []string
+
+	// FilePasswordKeyring is an optional keyring holding the password in the item FilePasswordKey,
+	// used instead of FilePasswordFunc
+	FilePasswordKeyring Keyring
+
+	// FilePasswordKey is the key of the password item on FilePasswordKeyring
+	FilePasswordKey string
+
+	// FileIndexPasswordFunc is an optional function used to obtain the passphrase for the metadata index,
+	// if nil no index is kept and GetMetadata only returns timestamps
+	FileIndexPasswordFunc PromptFunc
+
+	// FileIdentityFile is the path to an age identity file used to decrypt items encrypted to recipients,
+	// setting it (or adding a .age-recipients file to FileDir) switches the file backend to recipient mode
+	FileIdentityFile string
+
 	// FileDir is the directory that keyring files are stored in, ~/ is resolved to the users' home dir
 	FileDir string
 
-	// KeyCtlScope is the scope of the kernel keyring (either "user", "session", "process" or "thread")
+	// KeyCtlScope is the scope of the kernel keyring (either "user", "session", "process", "thread" or "persistent")
 	KeyCtlScope string
 
 	// KeyCtlPerm is the permission mask to use for new keys
 	KeyCtlPerm uint32
 
+	// KeyCtlTimeout is how long new keys last before the kernel expires them, 0 means they don't expire
+	KeyCtlTimeout time.Duration
+
+	// KeyCtlPersistentTimeout is how long the ServiceName keyring in the "persistent" scope lasts after
+	// it was last opened, 0 leaves it to the expiry of the persistent keyring (persistent_keyring_expiry)
+	KeyCtlPersistentTimeout time.Duration
+
+	// KeyCtlKeyType is the kernel key type items are stored as, either "user", "logon" or "big_key".
+	// "logon" keys hold only the Data, which the kernel can use but nobody can read back. By default
+	// items are "user" keys, or "big_key" keys when they are too large
+	KeyCtlKeyType string
+
 	// KWalletAppID is the application id for KWallet
 	KWalletAppID string
 
 	// KWalletFolder is the folder for KWallet
 	KWalletFolder string
 
-	// LibSecretCollectionName is the name collection in secret-service
+	// KWalletFormat is the format entries are stored in, either KWalletFormatJSON (the default) or
+	// KWalletFormatNative
+	KWalletFormat string
+
+	// LibSecretCollectionName is the name collection in secret-service, or an alias such as "default" for the
+	// user's default collection
 	LibSecretCollectionName string
 
+	// LibSecretAllowPlainSession allows falling back to sending secrets unencrypted over D-Bus
+	// when the secret-service doesn't support encrypted sessions
+	LibSecretAllowPlainSession bool
+
+	// LibSecretPromptTimeout is how long to wait for the user to answer a secret-service prompt, e.g. to
+	// unlock a collection, 0 means waiting indefinitely
+	LibSecretPromptTimeout time.Duration
+
 	// PassDir is the pass password-store directory, ~/ is resolved to the users' home dir
 	PassDir string
 
@@ -53,6 +101,60 @@ type Config struct {
 	// PassPrefix is a string prefix to prepend to the item path stored in pass
 	PassPrefix string
 
+	// PassFormat is the format entries are stored in, either PassFormatJSON (the default) or PassFormatPlain
+	PassFormat string
+
+	// PassProfile is the pass compatible program PassCmd is, either PassProfilePass (the default) or
+	// PassProfileGopass
+	PassProfile string
+
+	// PassEnv is extra environment, as "key=value" strings, for the commands run by the pass backend,
+	// e.g. PASSWORD_STORE_GPG_OPTS
+	PassEnv []string
+
+	// PassGnupgHome is the GNUPGHOME for the commands run by the pass backend, ~/ is resolved to the users' home dir
+	PassGnupgHome string
+
+	// PassNative is whether to read and write the password-store directly with a built-in OpenPGP
+	// implementation instead of running PassCmd
+	PassNative bool
+
+	// PassKeyringFiles are OpenPGP keyrings, armored or binary, holding the recipients' public keys
+	// and the user's secret keys for native mode (e.g. from gpg --export and gpg --export-secret-keys).
+	// The recipients in .gpg-id files are found by key ID, fingerprint or exact email address
+	PassKeyringFiles []string
+
+	// PassPasswordFunc is an optional function used to prompt the user for the passphrase of a secret key,
+	// when set gpg uses loopback pinentry rather than asking gpg-agent's pinentry
+	PassPasswordFunc PromptFunc
+
 	// WinCredPrefix is a string prefix to prepend to the key name
 	WinCredPrefix string
 }
+
+// Formats that the pass backend can store entries in.
+const (
+	// PassFormatJSON stores the whole Item as JSON
+	PassFormatJSON = "json"
+	// PassFormatPlain stores the Data on the first line, followed by the
+	// other fields as "key: value" lines, the common pass convention
+	PassFormatPlain = "plain"
+)
+
+// Formats that the kwallet backend can store entries in.
+const (
+	// KWalletFormatJSON stores the whole Item as JSON in a binary entry
+	KWalletFormatJSON = "json"
+	// KWalletFormatNative stores the Data as a password entry, like other KDE
+	// applications do, and the other fields as a map entry in the folder
+	// named KWalletFolder with ".metadata" appended
+	KWalletFormatNative = "native"
+)
+
+// Programs that the pass backend can use as PassCmd.
+const (
+	// PassProfilePass is the standard unix password manager
+	PassProfilePass = "pass"
+	// PassProfileGopass is gopass, whose store layout and flags differ
+	PassProfileGopass = "gopass"
+)
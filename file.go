@@ -1,42 +1,172 @@
 package keyring
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	jose "github.com/dvsekhvalnov/jose2go"
+	"github.com/dvsekhvalnov/jose2go/compact"
+	"github.com/dvsekhvalnov/jose2go/kdf"
 	"github.com/mtibben/percent"
 )
 
 func init() {
 	supportedBackends[FileBackend] = opener(func(cfg Config) (Keyring, error) {
+		if cfg.FileIdentityFile != "" || fileHasRecipients(cfg.FileDir) {
+			return &fileRecipientKeyring{
+				dir:          cfg.FileDir,
+				identityFile: cfg.FileIdentityFile,
+			}, nil
+		}
+
 		return &fileKeyring{
-			dir:          cfg.FileDir,
-			passwordFunc: cfg.FilePasswordFunc,
+			dir:               cfg.FileDir,
+			passwordFunc:      filePasswordFunc(cfg),
+			indexPasswordFunc: cfg.FileIndexPasswordFunc,
 		}, nil
 	})
 }
 
+// filePasswordFunc picks the source of the file keyring password. The
+// non-interactive sources take precedence over FilePasswordFunc.
+func filePasswordFunc(cfg Config) PromptFunc {
+	switch {
+	case cfg.FilePasswordFile != "":
+		return KeyfilePrompt(cfg.FilePasswordFile)
+	case len(cfg.FilePasswordCommand) > 0:
+		return CommandPrompt(cfg.FilePasswordCommand[0], cfg.FilePasswordCommand[1:]...)
+	case cfg.FilePasswordKeyring != nil:
+		return KeyringPrompt(cfg.FilePasswordKeyring, cfg.FilePasswordKey)
+	}
+	return cfg.FilePasswordFunc
+}
+
 var filenameEscape = func(s string) string {
 	return percent.Encode(s, "/")
 }
 var filenameUnescape = percent.Decode
 
+// fileIndexName is the name of the file within the keyring directory that
+// holds the encrypted non-secret parts of each item.
+const fileIndexName = ".keyring-index"
+
+// fileManifestName is the name of the file within the keyring directory that
+// holds an authenticated list of the keys on the keyring and the version of
+// each, so that deleted, rolled back or swapped items can be detected.
+const fileManifestName = ".keyring-manifest"
+
+// fileTempPrefix starts the names of the files written to the keyring
+// directory before being renamed into place.
+const fileTempPrefix = ".keyring-tmp-"
+
 type fileKeyring struct {
-	dir          string
-	passwordFunc PromptFunc
-	password     string
+	dir               string
+	passwordFunc      PromptFunc
+	password          string
+	indexPasswordFunc PromptFunc
+	indexPassword     string
+	manifestSalt      []byte
+	manifestKey       []byte
+}
+
+// fileManifest maps each key to the version of its item. Version 0 is used
+// for items written before the manifest existed, which carry no version.
+//
+// Pending lists the keys whose items are being changed, so that a change
+// interrupted between writing an item and the manifest isn't mistaken for
+// tampering. The item of a pending key may be missing, at its version in the
+// manifest or at the version of the counter, and the next change settles it.
+type fileManifest struct {
+	Salt    []byte           `json:"salt"`
+	Counter int64            `json:"counter"`
+	Entries map[string]int64 `json:"entries"`
+	Pending []string         `json:"pending,omitempty"`
+	MAC     []byte           `json:"mac"`
+}
+
+func (m *fileManifest) sum(key []byte) []byte {
+	keys := make([]string, 0, len(m.Entries))
+	for k := range m.Entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d\n", m.Counter)
+	for _, k := range keys {
+		fmt.Fprintf(mac, "%q %d\n", k, m.Entries[k])
+	}
+	for _, k := range m.Pending {
+		fmt.Fprintf(mac, "pending %q\n", k)
+	}
+
+	return mac.Sum(nil)
+}
+
+func (m *fileManifest) pending(key string) bool {
+	for _, k := range m.Pending {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+var errNoManifest = errors.New("The keyring has no manifest")
+
+func integrityError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrIntegrity, fmt.Sprintf(format, args...))
+}
+
+// isReservedName reports whether a file in the keyring directory is the
+// keyring's own rather than an item.
+func isReservedName(name string) bool {
+	return name == fileIndexName || name == fileManifestName || strings.HasPrefix(name, fileTempPrefix)
+}
+
+// writeFileAtomic replaces a file in the keyring directory by renaming a
+// complete copy over it, so that it's never left half written.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), fileTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
 }
 
 func (k *fileKeyring) resolveDir() (string, error) {
-	if k.dir == "" {
+	return resolveFileDir(k.dir)
+}
+
+// resolveFileDir expands the keyring directory and creates it if needed.
+func resolveFileDir(dir string) (string, error) {
+	if dir == "" {
 		return "", fmt.Errorf("No directory provided for file keyring")
 	}
 
-	dir, err := ExpandTilde(k.dir)
+	dir, err := ExpandTilde(dir)
 	if err != nil {
 		return "", err
 	}
@@ -68,6 +198,346 @@ func (k *fileKeyring) unlock() error {
 	return nil
 }
 
+// Lock forgets the passphrases, so they're prompted for again.
+func (k *fileKeyring) Lock() error {
+	k.password = ""
+	k.indexPassword = ""
+	for i := range k.manifestKey {
+		k.manifestKey[i] = 0
+	}
+	k.manifestKey = nil
+	k.manifestSalt = nil
+	return nil
+}
+
+// Close forgets the passphrases, like Lock.
+func (k *fileKeyring) Close() error {
+	return k.Lock()
+}
+
+func (k *fileKeyring) Unlock() error {
+	return k.unlock()
+}
+
+func (k *fileKeyring) IsLocked() (bool, error) {
+	return k.password == "", nil
+}
+
+func (k *fileKeyring) unlockIndex() error {
+	dir, err := k.resolveDir()
+	if err != nil {
+		return err
+	}
+
+	if k.indexPassword == "" {
+		pwd, err := k.indexPasswordFunc(fmt.Sprintf("Enter passphrase to unlock the metadata index of %q", dir))
+		if err != nil {
+			return err
+		}
+		k.indexPassword = pwd
+	}
+
+	return nil
+}
+
+// readIndex returns the metadata index, keyed by item key. The Data field of
+// each Item is always empty. A missing index is returned empty.
+func (k *fileKeyring) readIndex() (map[string]Item, error) {
+	dir, err := k.resolveDir()
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := os.ReadFile(filepath.Join(dir, fileIndexName))
+	if os.IsNotExist(err) {
+		return map[string]Item{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = k.unlockIndex(); err != nil {
+		return nil, err
+	}
+
+	payload, _, err := jose.Decode(string(bytes), k.indexPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[string]Item{}
+	err = json.Unmarshal([]byte(payload), &index)
+
+	return index, err
+}
+
+// index returns the metadata index to update, or nil if it isn't kept since
+// there's no index passphrase, see GetMetadata.
+func (k *fileKeyring) index() (map[string]Item, error) {
+	if k.indexPasswordFunc == nil {
+		return nil, nil
+	}
+
+	return k.readIndex()
+}
+
+func (k *fileKeyring) writeIndex(index map[string]Item) error {
+	bytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	if err = k.unlockIndex(); err != nil {
+		return err
+	}
+
+	token, err := jose.Encrypt(string(bytes), jose.PBES2_HS256_A128KW, jose.A256GCM, k.indexPassword)
+	if err != nil {
+		return err
+	}
+
+	dir, err := k.resolveDir()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, fileIndexName), []byte(token))
+}
+
+func (k *fileKeyring) manifestMACKey(salt []byte) ([]byte, error) {
+	if err := k.unlock(); err != nil {
+		return nil, err
+	}
+
+	if k.manifestKey == nil || !bytes.Equal(k.manifestSalt, salt) {
+		k.manifestKey = kdf.DerivePBKDF2([]byte(k.password), salt, 8192, 256, sha256.New)
+		k.manifestSalt = salt
+	}
+
+	return k.manifestKey, nil
+}
+
+// readManifest returns the verified manifest, or errNoManifest if the keyring
+// has none.
+func (k *fileKeyring) readManifest() (*fileManifest, error) {
+	dir, err := k.resolveDir()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, fileManifestName))
+	if os.IsNotExist(err) {
+		return nil, errNoManifest
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m fileManifest
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, integrityError("manifest is corrupt: %v", err)
+	}
+
+	key, err := k.manifestMACKey(m.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(m.MAC, m.sum(key)) {
+		return nil, integrityError("manifest authentication failed, either it was modified or the passphrase is wrong")
+	}
+	if m.Entries == nil {
+		m.Entries = map[string]int64{}
+	}
+
+	return &m, nil
+}
+
+// manifest returns the verified manifest.  Keyrings written before manifests
+// existed don't have one, so it's made up from their items at version 0; a
+// versioned item means the manifest was there and has been deleted.
+func (k *fileKeyring) manifest() (*fileManifest, error) {
+	m, err := k.readManifest()
+	if err != errNoManifest {
+		return m, err
+	}
+
+	dir, err := k.resolveDir()
+	if err != nil {
+		return nil, err
+	}
+
+	m = &fileManifest{Entries: map[string]int64{}}
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if !f.Type().IsRegular() || isReservedName(f.Name()) {
+			continue
+		}
+		header, ok := k.entryHeader(filepath.Join(dir, f.Name()))
+		if !ok {
+			continue
+		}
+		if _, ok := header["version"]; ok {
+			return nil, integrityError("the manifest is missing")
+		}
+		m.Entries[filenameUnescape(f.Name())] = 0
+	}
+
+	return m, nil
+}
+
+func (k *fileKeyring) writeManifest(m *fileManifest) error {
+	if m.Salt == nil {
+		m.Salt = make([]byte, 16)
+		if _, err := rand.Read(m.Salt); err != nil {
+			return err
+		}
+	}
+
+	key, err := k.manifestMACKey(m.Salt)
+	if err != nil {
+		return err
+	}
+	m.MAC = m.sum(key)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	dir, err := k.resolveDir()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, fileManifestName), b)
+}
+
+// updateManifest returns the manifest for a change to the keyring. A change
+// that was interrupted is settled first, and items written before the
+// manifest existed are bound to their key and a version, as unbound items are
+// only accepted from keyrings without a manifest.
+func (k *fileKeyring) updateManifest() (*fileManifest, error) {
+	m, err := k.manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range m.Pending {
+		filename, err := k.filename(key)
+		if err != nil {
+			return nil, err
+		}
+		header, ok := k.entryHeader(filename)
+		if !ok {
+			delete(m.Entries, key)
+			continue
+		}
+		if _, bound := header["key"]; !bound {
+			continue
+		}
+		if version, _ := header["version"].(float64); int64(version) == m.Counter {
+			m.Entries[key] = m.Counter
+		}
+	}
+	m.Pending = nil
+
+	for key, version := range m.Entries {
+		if version == 0 {
+			m.Pending = append(m.Pending, key)
+		}
+	}
+	if len(m.Pending) == 0 {
+		return m, nil
+	}
+
+	sort.Strings(m.Pending)
+	m.Counter++
+	if err = k.writeManifest(m); err != nil {
+		return nil, err
+	}
+	for _, key := range m.Pending {
+		if err = k.bindItem(key, m.Counter); err != nil {
+			return nil, err
+		}
+		m.Entries[key] = m.Counter
+	}
+	m.Pending = nil
+
+	return m, k.writeManifest(m)
+}
+
+// bindItem rewrites an item written before the manifest existed with its key
+// and version in the protected headers.
+func (k *fileKeyring) bindItem(key string, version int64) error {
+	filename, err := k.filename(key)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if err = k.unlock(); err != nil {
+		return err
+	}
+
+	payload, headers, err := jose.Decode(string(bytes), k.password)
+	if err != nil {
+		return err
+	}
+
+	created, ok := headers["created"]
+	if !ok {
+		created = time.Now().String()
+	}
+
+	return k.writeItem(filename, payload, created, key, version)
+}
+
+// writeItem encrypts an item under the passphrase. The protected headers are
+// authenticated along with the payload, which binds the item to its key and
+// version.
+func (k *fileKeyring) writeItem(filename, payload string, created interface{}, key string, version int64) error {
+	token, err := jose.Encrypt(payload, jose.PBES2_HS256_A128KW, jose.A256GCM, k.password,
+		jose.Headers(map[string]interface{}{
+			"created": created,
+			"key":     key,
+			"version": version,
+		}))
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, []byte(token))
+}
+
+// verifyItem checks the protected headers of an item against the manifest.
+// Keyrings without a manifest, see manifest, have nothing to check items
+// against.
+func (k *fileKeyring) verifyItem(m *fileManifest, key string, headers map[string]interface{}) error {
+	if m.MAC == nil {
+		return nil
+	}
+
+	boundKey, bound := headers["key"]
+	if bound && boundKey != key {
+		return integrityError("the file for %q holds the item for %q", key, boundKey)
+	}
+
+	version, _ := headers["version"].(float64)
+	expected, ok := m.Entries[key]
+	switch {
+	case m.pending(key) && (int64(version) == expected || bound && int64(version) == m.Counter):
+		return nil
+	case !ok:
+		return integrityError("%q is not in the manifest", key)
+	case !bound:
+		return integrityError("%q is not bound to its key", key)
+	case expected != int64(version):
+		return integrityError("%q is not the latest version", key)
+	}
+
+	return nil
+}
+
 func (k *fileKeyring) Get(key string) (Item, error) {
 	filename, err := k.filename(key)
 	if err != nil {
@@ -76,6 +546,14 @@ func (k *fileKeyring) Get(key string) (Item, error) {
 
 	bytes, err := os.ReadFile(filename)
 	if os.IsNotExist(err) {
+		// make sure the item hasn't been deleted behind our back
+		m, err := k.manifest()
+		if err != nil {
+			return Item{}, err
+		}
+		if _, ok := m.Entries[key]; ok && !m.pending(key) {
+			return Item{}, integrityError("%q has been deleted", key)
+		}
 		return Item{}, ErrKeyNotFound
 	} else if err != nil {
 		return Item{}, err
@@ -85,11 +563,19 @@ func (k *fileKeyring) Get(key string) (Item, error) {
 		return Item{}, err
 	}
 
-	payload, _, err := jose.Decode(string(bytes), k.password)
+	payload, headers, err := jose.Decode(string(bytes), k.password)
 	if err != nil {
 		return Item{}, err
 	}
 
+	m, err := k.manifest()
+	if err != nil {
+		return Item{}, err
+	}
+	if err = k.verifyItem(m, key, headers); err != nil {
+		return Item{}, err
+	}
+
 	var decoded Item
 	err = json.Unmarshal([]byte(payload), &decoded)
 
@@ -109,18 +595,30 @@ func (k *fileKeyring) GetMetadata(key string) (Metadata, error) {
 		return Metadata{}, err
 	}
 
+	md := Metadata{
+		ModificationTime: stat.ModTime(),
+	}
+
 	// For the File provider, all internal data is encrypted, not just the
-	// credentials.  Thus we only have the timestamps.  Return a nil *Item.
-	//
-	// If we want to change this ... how portable are extended file attributes
-	// these days?  Would it break user expectations of the security model to
-	// leak data into those?  I'm hesitant to do so.
+	// credentials.  The non-secret parts of each item are kept in a separate
+	// index, encrypted under its own passphrase.  Without one no index is
+	// kept, so like items written before the index existed, only the
+	// timestamps are returned with a nil *Item.
+	index, err := k.index()
+	if err != nil {
+		debugf("Unable to read the metadata index: %v", err)
+		return md, nil
+	}
 
-	return Metadata{
-		ModificationTime: stat.ModTime(),
-	}, nil
+	if item, ok := index[key]; ok {
+		md.Item = &item
+	}
+
+	return md, nil
 }
 
+// Set writes the item, and then the manifest with its new version. The key is
+// pending in the manifest meanwhile, see fileManifest.
 func (k *fileKeyring) Set(i Item) error {
 	bytes, err := json.Marshal(i)
 	if err != nil {
@@ -131,19 +629,43 @@ func (k *fileKeyring) Set(i Item) error {
 		return err
 	}
 
-	token, err := jose.Encrypt(string(bytes), jose.PBES2_HS256_A128KW, jose.A256GCM, k.password,
-		jose.Headers(map[string]interface{}{
-			"created": time.Now().String(),
-		}))
+	filename, err := k.filename(i.Key)
 	if err != nil {
 		return err
 	}
 
-	filename, err := k.filename(i.Key)
+	index, err := k.index()
+	if err != nil {
+		return err
+	}
+
+	m, err := k.updateManifest()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filename, []byte(token), 0600)
+	m.Counter++
+	m.Pending = []string{i.Key}
+	if err = k.writeManifest(m); err != nil {
+		return err
+	}
+
+	if err = k.writeItem(filename, string(bytes), time.Now().String(), i.Key, m.Counter); err != nil {
+		return err
+	}
+
+	m.Entries[i.Key] = m.Counter
+	m.Pending = nil
+	if err = k.writeManifest(m); err != nil {
+		return err
+	}
+
+	if index == nil {
+		return nil
+	}
+	i.Data = nil
+	index[i.Key] = i
+
+	return k.writeIndex(index)
 }
 
 func (k *fileKeyring) filename(key string) (string, error) {
@@ -152,7 +674,12 @@ func (k *fileKeyring) filename(key string) (string, error) {
 		return "", err
 	}
 
-	return filepath.Join(dir, filenameEscape(key)), nil
+	name := filenameEscape(key)
+	if isReservedName(name) {
+		return "", fmt.Errorf("%q is a reserved key name", key)
+	}
+
+	return filepath.Join(dir, name), nil
 }
 
 func (k *fileKeyring) Remove(key string) error {
@@ -161,10 +688,100 @@ func (k *fileKeyring) Remove(key string) error {
 		return err
 	}
 
-	return os.Remove(filename)
+	// check the manifest before touching anything, so that a tampered
+	// keyring is left as it is
+	m, err := k.updateManifest()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(filename); err != nil {
+		return err
+	}
+
+	// read the index first too, so that an index that can't be read leaves
+	// the item in place
+	index, err := k.index()
+	if err != nil {
+		return err
+	}
+
+	m.Pending = []string{key}
+	if err = k.writeManifest(m); err != nil {
+		return err
+	}
+
+	if err = os.Remove(filename); err != nil {
+		return err
+	}
+
+	delete(m.Entries, key)
+	m.Pending = nil
+	if err = k.writeManifest(m); err != nil {
+		return err
+	}
+
+	if _, ok := index[key]; !ok {
+		return nil
+	}
+	delete(index, key)
+
+	return k.writeIndex(index)
 }
 
+// entryHeader returns the protected header of the file at path, with ok false
+// unless it looks like an item written by the file keyring, i.e. a JWE in
+// compact serialization.
+func (k *fileKeyring) entryHeader(path string) (header map[string]interface{}, ok bool) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	parts, err := compact.Parse(string(bytes))
+	if err != nil || len(parts) != 5 {
+		return nil, false
+	}
+
+	if err = json.Unmarshal(parts[0], &header); err != nil {
+		return nil, false
+	}
+	_, ok = header["enc"]
+
+	return header, ok
+}
+
+// Keys lists the keys of the items, checked against the manifest. Verifying
+// the manifest needs the passphrase, which is prompted for unless the keyring
+// is unlocked; keyrings without a manifest are listed without it.
 func (k *fileKeyring) Keys() ([]string, error) {
+	keys, err := k.entryKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := k.manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	for _, key := range keys {
+		if _, ok := m.Entries[key]; !ok && !m.pending(key) {
+			return nil, integrityError("%q is not in the manifest", key)
+		}
+		found[key] = true
+	}
+	for key := range m.Entries {
+		if !found[key] && !m.pending(key) {
+			return nil, integrityError("%q has been deleted", key)
+		}
+	}
+
+	return keys, nil
+}
+
+// entryKeys lists the keys of the items in the keyring directory.
+func (k *fileKeyring) entryKeys() ([]string, error) {
 	dir, err := k.resolveDir()
 	if err != nil {
 		return nil, err
@@ -173,6 +790,12 @@ func (k *fileKeyring) Keys() ([]string, error) {
 	var keys = []string{}
 	files, _ := os.ReadDir(dir)
 	for _, f := range files {
+		if !f.Type().IsRegular() || isReservedName(f.Name()) {
+			continue
+		}
+		if _, ok := k.entryHeader(filepath.Join(dir, f.Name())); !ok {
+			continue
+		}
 		keys = append(keys, filenameUnescape(f.Name()))
 	}
 
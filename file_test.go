@@ -1,8 +1,13 @@
 package keyring
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+
+	jose "github.com/dvsekhvalnov/jose2go"
 )
 
 func TestFileKeyringSetWhenEmpty(t *testing.T) {
@@ -59,3 +64,466 @@ func TestFilenameWithBadChars(t *testing.T) {
 		t.Fatal("Unexpected filenameEscape")
 	}
 }
+
+func TestFileKeyringGetMetadataFromIndex(t *testing.T) {
+	k := &fileKeyring{
+		dir:               t.TempDir(),
+		passwordFunc:      FixedStringPrompt("no more secrets"),
+		indexPasswordFunc: FixedStringPrompt("not a secret"),
+	}
+	item := Item{Key: "llamas", Data: []byte("llamas are great"), Label: "Llamas", Description: "A llama fact"}
+
+	if err := k.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	k = &fileKeyring{
+		dir: k.dir,
+		passwordFunc: func(string) (string, error) {
+			t.Fatal("GetMetadata should not prompt for the item passphrase")
+			return "", nil
+		},
+		indexPasswordFunc: FixedStringPrompt("not a secret"),
+	}
+
+	md, err := k.GetMetadata("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Item == nil {
+		t.Fatal("Expected metadata to include the item")
+	}
+	if md.Label != "Llamas" || md.Description != "A llama fact" {
+		t.Fatalf("Unexpected metadata: %+v", md.Item)
+	}
+	if len(md.Data) != 0 {
+		t.Fatalf("Metadata leaked the secret: %q", md.Data)
+	}
+}
+
+func TestFileKeyringKeysSkipsStrayFiles(t *testing.T) {
+	k := &fileKeyring{
+		dir:          t.TempDir(),
+		passwordFunc: FixedStringPrompt("no more secrets"),
+	}
+
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(k.dir, ".DS_Store"), []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// left behind by an interrupted write
+	llamas, _ := os.ReadFile(filepath.Join(k.dir, "llamas"))
+	if err := os.WriteFile(filepath.Join(k.dir, fileTempPrefix+"123"), llamas, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := k.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "llamas" {
+		t.Fatalf("Expected only llamas, got %v", keys)
+	}
+
+	if err := k.Remove("llamas"); err != nil {
+		t.Fatal(err)
+	}
+	md, err := k.GetMetadata("llamas")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v (%+v)", err, md)
+	}
+}
+
+func TestFileKeyringUnlockWithoutPrompt(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "keyfile")
+	if err := os.WriteFile(keyfile, []byte("no more secrets\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passwords := NewArrayKeyring([]Item{{Key: "file-password", Data: []byte("no more secrets")}})
+
+	configs := map[string]Config{
+		"keyfile": {FilePasswordFile: keyfile},
+		"keyring": {FilePasswordKeyring: passwords, FilePasswordKey: "file-password"},
+	}
+	if runtime.GOOS != "windows" {
+		configs["command"] = Config{FilePasswordCommand: []string{"echo", "no more secrets"}}
+	}
+
+	dir := t.TempDir()
+	for name, cfg := range configs {
+		cfg.FileDir = dir
+		cfg.FilePasswordFunc = func(string) (string, error) {
+			t.Fatalf("%s: FilePasswordFunc should not be called", name)
+			return "", nil
+		}
+
+		k := &fileKeyring{dir: dir, passwordFunc: filePasswordFunc(cfg)}
+		if err := k.Set(Item{Key: name, Data: []byte("llamas are great")}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		k = &fileKeyring{dir: dir, passwordFunc: FixedStringPrompt("no more secrets")}
+		if _, err := k.Get(name); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestFileKeyringDetectsTampering(t *testing.T) {
+	newKeyring := func(t *testing.T) *fileKeyring {
+		t.Helper()
+		k := &fileKeyring{
+			dir:          t.TempDir(),
+			passwordFunc: FixedStringPrompt("no more secrets"),
+		}
+		for _, item := range []Item{
+			{Key: "llamas", Data: []byte("llamas are great")},
+			{Key: "alpacas", Data: []byte("alpacas are better")},
+		} {
+			if err := k.Set(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return k
+	}
+
+	t.Run("swapped", func(t *testing.T) {
+		k := newKeyring(t)
+		llamas, _ := os.ReadFile(filepath.Join(k.dir, "llamas"))
+		alpacas, _ := os.ReadFile(filepath.Join(k.dir, "alpacas"))
+		_ = os.WriteFile(filepath.Join(k.dir, "llamas"), alpacas, 0600)
+		_ = os.WriteFile(filepath.Join(k.dir, "alpacas"), llamas, 0600)
+
+		if _, err := k.Get("llamas"); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+	})
+
+	t.Run("rolled back", func(t *testing.T) {
+		k := newKeyring(t)
+		old, _ := os.ReadFile(filepath.Join(k.dir, "llamas"))
+		if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are okay")}); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.WriteFile(filepath.Join(k.dir, "llamas"), old, 0600)
+
+		if _, err := k.Get("llamas"); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		k := newKeyring(t)
+		_ = os.Remove(filepath.Join(k.dir, "llamas"))
+
+		if _, err := k.Get("llamas"); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+		if _, err := k.Keys(); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+		if err := k.Remove("alpacas"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := k.Get("alpacas"); err != ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+		}
+	})
+
+	t.Run("manifest deleted", func(t *testing.T) {
+		k := newKeyring(t)
+		_ = os.Remove(filepath.Join(k.dir, fileManifestName))
+
+		if _, err := k.Get("llamas"); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+		if _, err := k.Get("unicorns"); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+		if _, err := k.Keys(); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+		if err := k.Set(Item{Key: "unicorns", Data: []byte("unicorns are real")}); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+		if err := k.Remove("llamas"); !errors.Is(err, ErrIntegrity) {
+			t.Fatalf("Expected ErrIntegrity, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(k.dir, "llamas")); err != nil {
+			t.Fatalf("Expected the item to be left in place, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(k.dir, fileManifestName)); !os.IsNotExist(err) {
+			t.Fatalf("Expected no manifest to be written, got %v", err)
+		}
+	})
+}
+
+func TestFileKeyringWithoutManifest(t *testing.T) {
+	k := &fileKeyring{
+		dir:          t.TempDir(),
+		passwordFunc: FixedStringPrompt("no more secrets"),
+	}
+
+	// an item as written before the manifest existed
+	token, err := jose.Encrypt(`{"Key":"llamas","Data":"bGxhbWFzIGFyZSBncmVhdA=="}`, jose.PBES2_HS256_A128KW, jose.A256GCM, "no more secrets",
+		jose.Headers(map[string]interface{}{"created": "yesterday"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(k.dir, "llamas"), []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if item, err := k.Get("llamas"); err != nil || string(item.Data) != "llamas are great" {
+		t.Fatalf("Expected the item, got %+v, %v", item, err)
+	}
+	if _, err := k.Get("alpacas"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err = k.Set(Item{Key: "alpacas", Data: []byte("alpacas are better")}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := k.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %v", keys)
+	}
+	if _, err = k.Get("llamas"); err != nil {
+		t.Fatal(err)
+	}
+
+	// writing the manifest bound the old item to its key and a version,
+	// after which unbound items aren't accepted
+	header, _ := k.entryHeader(filepath.Join(k.dir, "llamas"))
+	if header["key"] != "llamas" || header["version"] == nil || header["created"] != "yesterday" {
+		t.Fatalf("Expected the item to be bound, got %v", header)
+	}
+	if err = os.WriteFile(filepath.Join(k.dir, "llamas"), []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Get("llamas"); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("Expected ErrIntegrity, got %v", err)
+	}
+}
+
+func TestFileKeyringInterruptedChanges(t *testing.T) {
+	k := &fileKeyring{
+		dir:          t.TempDir(),
+		passwordFunc: FixedStringPrompt("no more secrets"),
+	}
+	for _, item := range []Item{
+		{Key: "llamas", Data: []byte("llamas are great")},
+		{Key: "alpacas", Data: []byte("alpacas are better")},
+	} {
+		if err := k.Set(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// begin is what Set and Remove do before changing an item
+	begin := func(key string) *fileManifest {
+		t.Helper()
+		m, err := k.updateManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Counter++
+		m.Pending = []string{key}
+		if err = k.writeManifest(m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	check := func(key, data string) {
+		t.Helper()
+		item, err := k.Get(key)
+		if data == "" && err != ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound for %s, got %+v, %v", key, item, err)
+		} else if data != "" && (err != nil || string(item.Data) != data) {
+			t.Fatalf("Expected %q for %s, got %+v, %v", data, key, item, err)
+		}
+		if _, err = k.Keys(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// before the item is written
+	begin("llamas")
+	check("llamas", "llamas are great")
+	begin("unicorns")
+	check("unicorns", "")
+
+	// after the item is written
+	m := begin("llamas")
+	if err := k.writeItem(filepath.Join(k.dir, "llamas"), `{"Key":"llamas","Data":"bGxhbWFzIGFyZSBva2F5"}`, "now", "llamas", m.Counter); err != nil {
+		t.Fatal(err)
+	}
+	check("llamas", "llamas are okay")
+
+	// after the item is removed
+	begin("alpacas")
+	if err := os.Remove(filepath.Join(k.dir, "alpacas")); err != nil {
+		t.Fatal(err)
+	}
+	check("alpacas", "")
+
+	// the next change settles them
+	if err := k.Set(Item{Key: "unicorns", Data: []byte("unicorns are real")}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := k.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Pending) != 0 || len(m.Entries) != 2 {
+		t.Fatalf("Expected the changes to be settled, got %+v", m)
+	}
+	check("llamas", "llamas are okay")
+	check("alpacas", "")
+	check("unicorns", "unicorns are real")
+}
+
+func TestFileKeyringKeysPrompts(t *testing.T) {
+	dir := t.TempDir()
+	k := &fileKeyring{dir: dir, passwordFunc: FixedStringPrompt("no more secrets")}
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the passphrase is needed to verify the manifest
+	prompts := 0
+	k = &fileKeyring{dir: dir, passwordFunc: func(string) (string, error) {
+		prompts++
+		return "no more secrets", nil
+	}}
+	for i := 0; i < 2; i++ {
+		if keys, err := k.Keys(); err != nil || len(keys) != 1 {
+			t.Fatalf("Expected 1 key, got %v, %v", keys, err)
+		}
+	}
+	if prompts != 1 {
+		t.Fatalf("Expected 1 prompt, got %d", prompts)
+	}
+
+	k = &fileKeyring{dir: dir, passwordFunc: func(string) (string, error) {
+		return "", errors.New("cancelled")
+	}}
+	if _, err := k.Keys(); err == nil {
+		t.Fatal("Expected Keys to fail without the passphrase")
+	}
+
+	// there's nothing to verify without a manifest
+	if err := os.Remove(filepath.Join(dir, fileManifestName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "llamas")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := k.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("Expected no keys, got %v, %v", keys, err)
+	}
+}
+
+func TestFileKeyringLock(t *testing.T) {
+	prompts := 0
+	k := &fileKeyring{
+		dir: t.TempDir(),
+		passwordFunc: func(string) (string, error) {
+			prompts++
+			return "no more secrets", nil
+		},
+	}
+
+	var l Locker = k
+	if locked, _ := l.IsLocked(); !locked {
+		t.Fatal("Expected the keyring to start locked")
+	}
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := l.IsLocked(); locked {
+		t.Fatal("Expected the keyring to be unlocked")
+	}
+
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := l.IsLocked(); !locked {
+		t.Fatal("Expected the keyring to be locked")
+	}
+	if _, err := k.Get("llamas"); err != nil {
+		t.Fatal(err)
+	}
+	if prompts != 2 {
+		t.Fatalf("Expected the passphrase to be prompted for again, got %d prompts", prompts)
+	}
+}
+
+func TestFileKeyringGetMetadataWithoutIndexPassword(t *testing.T) {
+	dir := t.TempDir()
+	k := &fileKeyring{
+		dir:          dir,
+		passwordFunc: FixedStringPrompt("no more secrets"),
+	}
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great"), Label: "Llamas"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, fileIndexName)); !os.IsNotExist(err) {
+		t.Fatalf("Expected no index to be kept, got %v", err)
+	}
+
+	noPrompt := func(string) (string, error) {
+		t.Fatal("GetMetadata should not prompt")
+		return "", nil
+	}
+
+	// Without an index passphrase the index isn't read at all
+	k = &fileKeyring{dir: dir, passwordFunc: noPrompt}
+	md, err := k.GetMetadata("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Item != nil || md.ModificationTime.IsZero() {
+		t.Fatalf("Expected only the timestamps, got %+v", md)
+	}
+
+	// An index that can't be read falls back to the timestamps
+	k = &fileKeyring{dir: dir, passwordFunc: noPrompt, indexPasswordFunc: FixedStringPrompt("wrong")}
+	md, err = k.GetMetadata("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Item != nil || md.ModificationTime.IsZero() {
+		t.Fatalf("Expected only the timestamps, got %+v", md)
+	}
+}
+
+func TestFileKeyringRemoveWithWrongIndexPassword(t *testing.T) {
+	dir := t.TempDir()
+	k := &fileKeyring{
+		dir:               dir,
+		passwordFunc:      FixedStringPrompt("no more secrets"),
+		indexPasswordFunc: FixedStringPrompt("not a secret"),
+	}
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great"), Label: "Llamas"}); err != nil {
+		t.Fatal(err)
+	}
+
+	k = &fileKeyring{
+		dir:               dir,
+		passwordFunc:      FixedStringPrompt("no more secrets"),
+		indexPasswordFunc: FixedStringPrompt("wrong"),
+	}
+	if err := k.Remove("llamas"); err == nil {
+		t.Fatal("Expected Remove to fail")
+	}
+	if _, err := k.Get("llamas"); err != nil {
+		t.Fatalf("Expected the item to be left in place, got %v", err)
+	}
+}
@@ -0,0 +1,482 @@
+package keyring
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// fileRecipientsName is the name of the file listing the age recipients that
+// items in a directory, and the directories below it, are encrypted to. It
+// plays the same role as the .gpg-id file of a pass password-store.
+const fileRecipientsName = ".age-recipients"
+
+const fileRecipientExt = ".age"
+
+// fileRecipientGitDir is the directory git keeps below a keyring directory
+// that is shared as a repository. It never holds items, so it's skipped when
+// listing them and can't be part of a key.
+const fileRecipientGitDir = ".git"
+
+var errNoRecipients = errors.New("No recipients found")
+
+// fileHasRecipients reports whether dir has been initialised with recipients.
+func fileHasRecipients(dir string) bool {
+	if dir == "" {
+		return false
+	}
+
+	dir, err := ExpandTilde(dir)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(filepath.Join(dir, fileRecipientsName))
+	return err == nil
+}
+
+// fileRecipientKeyring is the recipient mode of the file backend. Each item is
+// stored as an age file encrypted to every recipient listed for its directory,
+// so a directory can be shared (e.g. in a git repository) by a team where each
+// member decrypts with their own identity.
+type fileRecipientKeyring struct {
+	dir          string
+	identityFile string
+	identities   []age.Identity
+}
+
+// path maps a slash-separated key or directory to a path below the keyring
+// directory, escaping each segment individually.
+func (k *fileRecipientKeyring) path(key string) (string, error) {
+	dir, err := resolveFileDir(k.dir)
+	if err != nil {
+		return "", err
+	}
+
+	if key == "" {
+		return dir, nil
+	}
+
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		if s == "" || s == "." || s == ".." || s == fileRecipientGitDir {
+			return "", fmt.Errorf("Invalid key %q", key)
+		}
+		segments[i] = filenameEscape(s)
+	}
+
+	return filepath.Join(dir, filepath.Join(segments...)), nil
+}
+
+func (k *fileRecipientKeyring) filename(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("Invalid key %q", key)
+	}
+
+	p, err := k.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	return p + fileRecipientExt, nil
+}
+
+func (k *fileRecipientKeyring) unlock() error {
+	if k.identities != nil {
+		return nil
+	}
+
+	if k.identityFile == "" {
+		return fmt.Errorf("No identity file provided for file keyring")
+	}
+
+	filename, err := ExpandTilde(k.identityFile)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return fmt.Errorf("reading identity file %q failed: %v", filename, err)
+	}
+	k.identities = identities
+
+	return nil
+}
+
+// Lock forgets the identities, so the identity file is read again.
+func (k *fileRecipientKeyring) Lock() error {
+	k.identities = nil
+	return nil
+}
+
+// Close forgets the identities, like Lock.
+func (k *fileRecipientKeyring) Close() error {
+	return k.Lock()
+}
+
+func (k *fileRecipientKeyring) Unlock() error {
+	return k.unlock()
+}
+
+func (k *fileRecipientKeyring) IsLocked() (bool, error) {
+	return k.identities == nil, nil
+}
+
+func readRecipientsFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	recipients := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		recipients = append(recipients, line)
+	}
+
+	return recipients, scanner.Err()
+}
+
+// recipientsForDir returns the recipients from the nearest recipients file in
+// dir or any of its parents up to the keyring directory.
+func (k *fileRecipientKeyring) recipientsForDir(dir string) ([]string, error) {
+	return k.recipientsReplacing(dir, "", nil)
+}
+
+// recipientsReplacing is recipientsForDir with the recipients of setDir
+// replaced by set, as they will be once SetRecipients writes them.
+func (k *fileRecipientKeyring) recipientsReplacing(dir, setDir string, set []string) ([]string, error) {
+	root, err := resolveFileDir(k.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if dir == setDir {
+			return set, nil
+		}
+		recipients, err := readRecipientsFile(filepath.Join(dir, fileRecipientsName))
+		if err == nil {
+			return recipients, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if dir == root || !strings.HasPrefix(dir, root) {
+			return nil, fmt.Errorf("%w for %q, add a %s file", errNoRecipients, dir, fileRecipientsName)
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (k *fileRecipientKeyring) encrypt(filename string, i Item) error {
+	recipients, err := k.recipientsForDir(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+
+	return k.encryptTo(filename, i, recipients)
+}
+
+func (k *fileRecipientKeyring) encryptTo(filename string, i Item, recipients []string) error {
+	parsed, err := parseRecipients(recipients)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, parsed...)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(payload); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0600)
+}
+
+func (k *fileRecipientKeyring) decrypt(filename string) (Item, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return Item{}, ErrKeyNotFound
+	} else if err != nil {
+		return Item{}, err
+	}
+	defer f.Close()
+
+	if err = k.unlock(); err != nil {
+		return Item{}, err
+	}
+
+	r, err := age.Decrypt(f, k.identities...)
+	if err != nil {
+		return Item{}, err
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return Item{}, err
+	}
+
+	var decoded Item
+	err = json.Unmarshal(payload, &decoded)
+
+	return decoded, err
+}
+
+func parseRecipients(recipients []string) ([]age.Recipient, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("At least one recipient is required")
+	}
+
+	parsed := make([]age.Recipient, 0, len(recipients))
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, recipient)
+	}
+
+	return parsed, nil
+}
+
+func (k *fileRecipientKeyring) Get(key string) (Item, error) {
+	filename, err := k.filename(key)
+	if err != nil {
+		return Item{}, err
+	}
+
+	return k.decrypt(filename)
+}
+
+func (k *fileRecipientKeyring) GetMetadata(key string) (Metadata, error) {
+	filename, err := k.filename(key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	stat, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return Metadata{}, ErrKeyNotFound
+	} else if err != nil {
+		return Metadata{}, err
+	}
+
+	// As with the passphrase mode, everything but the timestamps is encrypted.
+	return Metadata{
+		ModificationTime: stat.ModTime(),
+	}, nil
+}
+
+func (k *fileRecipientKeyring) Set(i Item) error {
+	filename, err := k.filename(i.Key)
+	if err != nil {
+		return err
+	}
+
+	return k.encrypt(filename, i)
+}
+
+func (k *fileRecipientKeyring) Remove(key string) error {
+	filename, err := k.filename(key)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filename)
+}
+
+// walk calls fn with the filename and key of every item below dir.
+func (k *fileRecipientKeyring) walk(dir string, fn func(filename, key string) error) error {
+	root, err := resolveFileDir(k.dir)
+	if err != nil {
+		return err
+	}
+
+	start, err := k.path(dir)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == start {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == fileRecipientGitDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || filepath.Ext(p) != fileRecipientExt {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, strings.TrimSuffix(p, fileRecipientExt))
+		if err != nil {
+			return err
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		for i, s := range segments {
+			segments[i] = filenameUnescape(s)
+		}
+
+		return fn(p, strings.Join(segments, "/"))
+	})
+}
+
+func (k *fileRecipientKeyring) Keys() ([]string, error) {
+	keys := []string{}
+	err := k.walk("", func(_, key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+
+	return keys, err
+}
+
+func (k *fileRecipientKeyring) Recipients(key string) ([]string, error) {
+	filename, err := k.filename(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.recipientsForDir(filepath.Dir(filename))
+}
+
+func (k *fileRecipientKeyring) SetRecipients(dir string, recipients []string) error {
+	if _, err := parseRecipients(recipients); err != nil {
+		return err
+	}
+
+	p, err := k.path(dir)
+	if err != nil {
+		return err
+	}
+
+	// The items are re-encrypted before the recipients file is written, so
+	// that a failure leaves the file naming recipients who can read them
+	err = k.walk(dir, func(filename, key string) error {
+		item, err := k.decrypt(filename)
+		if err != nil {
+			return fmt.Errorf("decrypting %q failed: %v", key, err)
+		}
+
+		r, err := k.recipientsReplacing(filepath.Dir(filename), p, recipients)
+		if err != nil {
+			return err
+		}
+
+		return k.encryptTo(filename, item, r)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(p, 0700); err != nil {
+		return err
+	}
+
+	contents := strings.Join(recipients, "\n") + "\n"
+	return os.WriteFile(filepath.Join(p, fileRecipientsName), []byte(contents), 0600)
+}
+
+func (k *fileRecipientKeyring) AddRecipients(dir string, recipients ...string) error {
+	p, err := k.path(dir)
+	if err != nil {
+		return err
+	}
+
+	current, err := k.recipientsForDir(p)
+	if errors.Is(err, errNoRecipients) {
+		current = []string{}
+	} else if err != nil {
+		return err
+	}
+
+	for _, r := range recipients {
+		if !containsString(current, r) {
+			current = append(current, r)
+		}
+	}
+
+	return k.SetRecipients(dir, current)
+}
+
+func (k *fileRecipientKeyring) RemoveRecipients(dir string, recipients ...string) error {
+	p, err := k.path(dir)
+	if err != nil {
+		return err
+	}
+
+	current, err := k.recipientsForDir(p)
+	if err != nil {
+		return err
+	}
+
+	remaining := []string{}
+	for _, r := range current {
+		if !containsString(recipients, r) {
+			remaining = append(remaining, r)
+		}
+	}
+
+	return k.SetRecipients(dir, remaining)
+}
+
+func (k *fileRecipientKeyring) Reencrypt(dir string) error {
+	return k.walk(dir, func(filename, key string) error {
+		item, err := k.decrypt(filename)
+		if err != nil {
+			return fmt.Errorf("decrypting %q failed: %v", key, err)
+		}
+
+		return k.encrypt(filename, item)
+	})
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package keyring
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func newTestIdentity(t *testing.T, dir string) (*age.X25519Identity, string) {
+	t.Helper()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, identity.Recipient().String()[:12]+".txt")
+	if err := os.WriteFile(filename, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return identity, filename
+}
+
+func TestFileRecipientKeyringSetAndGet(t *testing.T) {
+	alice, aliceFile := newTestIdentity(t, t.TempDir())
+	bob, bobFile := newTestIdentity(t, t.TempDir())
+	dir := t.TempDir()
+
+	k := &fileRecipientKeyring{dir: dir, identityFile: aliceFile}
+	if err := k.SetRecipients("", []string{alice.Recipient().String(), bob.Recipient().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	item := Item{Key: "aws/production", Data: []byte("llamas are great")}
+	if err := k.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, identityFile := range []string{aliceFile, bobFile} {
+		k := &fileRecipientKeyring{dir: dir, identityFile: identityFile}
+		foundItem, err := k.Get("aws/production")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(foundItem.Data) != "llamas are great" {
+			t.Fatalf("Value stored was not the value retrieved: %q", foundItem.Data)
+		}
+	}
+
+	keys, err := k.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"aws/production"}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+}
+
+func TestFileRecipientKeyringSubdirectoryRecipients(t *testing.T) {
+	alice, aliceFile := newTestIdentity(t, t.TempDir())
+	bob, bobFile := newTestIdentity(t, t.TempDir())
+	dir := t.TempDir()
+
+	k := &fileRecipientKeyring{dir: dir, identityFile: aliceFile}
+	if err := k.SetRecipients("", []string{alice.Recipient().String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set(Item{Key: "shared/llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set(Item{Key: "private", Data: []byte("alpacas are better")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.AddRecipients("shared", bob.Recipient().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := k.Recipients("shared/llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(recipients)
+	expected := []string{alice.Recipient().String(), bob.Recipient().String()}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(recipients, expected) {
+		t.Fatalf("Expected recipients %v, got %v", expected, recipients)
+	}
+
+	kb := &fileRecipientKeyring{dir: dir, identityFile: bobFile}
+	if _, err := kb.Get("shared/llamas"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kb.Get("private"); err == nil {
+		t.Fatal("Expected bob to be unable to decrypt private")
+	}
+
+	if err := k.RemoveRecipients("shared", bob.Recipient().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kb.Get("shared/llamas"); err == nil {
+		t.Fatal("Expected bob to be unable to decrypt after removal")
+	}
+}
+
+func TestFileRecipientKeyringRemoveWhenEmpty(t *testing.T) {
+	alice, aliceFile := newTestIdentity(t, t.TempDir())
+
+	k := &fileRecipientKeyring{dir: t.TempDir(), identityFile: aliceFile}
+	if err := k.SetRecipients("", []string{alice.Recipient().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// like the passphrase mode, the error from removing the file is returned
+	if err := k.Remove("no-such-key"); !os.IsNotExist(err) {
+		t.Fatalf("expected a not exist error, got: %v", err)
+	}
+	if _, err := k.Get("../escape"); err == nil {
+		t.Fatal("expected an error for a key outside the keyring")
+	}
+}
+
+func TestFileRecipientKeyringDotDirectories(t *testing.T) {
+	alice, aliceFile := newTestIdentity(t, t.TempDir())
+	bob, bobFile := newTestIdentity(t, t.TempDir())
+	dir := t.TempDir()
+
+	k := &fileRecipientKeyring{dir: dir, identityFile: aliceFile}
+	if err := k.SetRecipients("", []string{alice.Recipient().String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set(Item{Key: ".ssh/id", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// git's own files are never items
+	if err := os.MkdirAll(filepath.Join(dir, ".git"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".git", "stray.age"), []byte("not an item"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set(Item{Key: ".git/stray", Data: []byte("alpacas are better")}); err == nil {
+		t.Fatal("Expected an error for a key in the git directory")
+	}
+
+	keys, err := k.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{".ssh/id"}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+
+	if err := k.AddRecipients(".ssh", bob.Recipient().String()); err != nil {
+		t.Fatal(err)
+	}
+	kb := &fileRecipientKeyring{dir: dir, identityFile: bobFile}
+	if _, err := kb.Get(".ssh/id"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileRecipientKeyringAddRecipientsWhenUnreadable(t *testing.T) {
+	bob, _ := newTestIdentity(t, t.TempDir())
+	dir := t.TempDir()
+
+	// a recipients file that can't be read mustn't be taken for no recipients
+	if err := os.MkdirAll(filepath.Join(dir, fileRecipientsName), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &fileRecipientKeyring{dir: dir}
+	if err := k.AddRecipients("shared", bob.Recipient().String()); err == nil {
+		t.Fatal("Expected an error reading the recipients")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "shared", fileRecipientsName)); !os.IsNotExist(err) {
+		t.Fatalf("Expected no recipients file to be written, got %v", err)
+	}
+}
+
+func TestFileRecipientKeyringSetRecipientsWhenUndecryptable(t *testing.T) {
+	alice, aliceFile := newTestIdentity(t, t.TempDir())
+	bob, _ := newTestIdentity(t, t.TempDir())
+	carol, _ := newTestIdentity(t, t.TempDir())
+	dir := t.TempDir()
+
+	// an item alice can't decrypt
+	k := &fileRecipientKeyring{dir: dir, identityFile: aliceFile}
+	if err := k.SetRecipients("", []string{bob.Recipient().String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the recipients file is only written once the items are re-encrypted
+	err := k.SetRecipients("", []string{alice.Recipient().String(), carol.Recipient().String()})
+	if err == nil {
+		t.Fatal("Expected re-encrypting to fail")
+	}
+	recipients, err := k.recipientsForDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 1 || recipients[0] != bob.Recipient().String() {
+		t.Fatalf("Expected the recipients to be left as they were, got %v", recipients)
+	}
+}
@@ -270,6 +270,11 @@ func (k *keychain) Keys() ([]string, error) {
 	return accountNames, nil
 }
 
+// Close does nothing, the keychain holds no resources between calls.
+func (k *keychain) Close() error {
+	return nil
+}
+
 func (k *keychain) createOrOpen() (gokeychain.Keychain, error) {
 	kc := gokeychain.NewWithPath(k.path)
 
@@ -4,10 +4,17 @@
 package keyring
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -49,18 +56,157 @@ func GetKeyringIDForScope(scope string) (int32, error) {
 	return int32(id), err
 }
 
+// keyctlEnvelopeMagic prefixes payloads holding a whole Item, followed by a
+// version byte and the JSON encoded keyctlEnvelope. Payloads without it are raw
+// Data as written by earlier versions or other programs.
+const keyctlEnvelopeMagic = "\x00keyring"
+
+const (
+	keyctlEnvelopeVersion = byte(1)
+	// keyctlChunksVersion marks a payload holding the number of chunks an
+	// envelope too large for a single key was split over
+	keyctlChunksVersion = byte(2)
+)
+
+// keyctlUserMaxPayload is the largest payload the kernel accepts for "user" keys.
+const keyctlUserMaxPayload = 32767
+
+// keyctlChunkPrefix starts the descriptions of the keys holding chunks, which
+// are hidden from Keys.
+const keyctlChunkPrefix = ".keyring-chunk:"
+
+// keyctlChunks are the keys an envelope too large for a single key is split
+// over. Every Set writes a new generation of chunks, so that the item only
+// switches over to them once they are all stored.
+type keyctlChunks struct {
+	Count      int
+	Generation string
+}
+
+func (c keyctlChunks) name(name string, i int) string {
+	return fmt.Sprintf("%s%s:%d:%s", keyctlChunkPrefix, c.Generation, i, name)
+}
+
+func keyctlEncodeChunks(c keyctlChunks) []byte {
+	payload := append([]byte(keyctlEnvelopeMagic), keyctlChunksVersion)
+	return append(strconv.AppendInt(payload, int64(c.Count), 10), ":"+c.Generation...)
+}
+
+func keyctlDecodeChunks(payload []byte) (keyctlChunks, bool) {
+	prefix := keyctlEnvelopeMagic + string(keyctlChunksVersion)
+	if !bytes.HasPrefix(payload, []byte(prefix)) {
+		return keyctlChunks{}, false
+	}
+
+	count, generation, found := strings.Cut(string(payload[len(prefix):]), ":")
+	if !found {
+		return keyctlChunks{}, false
+	}
+	chunks, err := strconv.Atoi(count)
+	if err != nil {
+		return keyctlChunks{}, false
+	}
+
+	return keyctlChunks{Count: chunks, Generation: generation}, true
+}
+
+// keyctlQuota returns how many bytes of descriptions and payloads the keys of
+// the user may hold in total, which /proc/key-users lists along with the
+// bytes in use. The limit is kernel/keys/maxbytes, or root_maxbytes for root.
+func keyctlQuota() (int, error) {
+	data, err := os.ReadFile("/proc/key-users")
+	if err != nil {
+		return 0, err
+	}
+
+	uid := strconv.Itoa(os.Geteuid()) + ":"
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != uid {
+			continue
+		}
+		_, max, _ := strings.Cut(fields[4], "/")
+		return strconv.Atoi(max)
+	}
+
+	return 0, fmt.Errorf("no quota found for uid %d", os.Geteuid())
+}
+
+// keyctlChunkSize returns the size of chunks, small enough that a chunk fits
+// in the key quota of the user alongside other keys.
+func keyctlChunkSize() int {
+	size := keyctlUserMaxPayload
+	if quota, err := keyctlQuota(); err == nil && quota/2 < size {
+		size = quota / 2
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	return size
+}
+
+// keyctlQuotaError explains running out of the key quota of the user.
+func keyctlQuotaError(size int, err error) error {
+	return fmt.Errorf("the keys of the user can't hold another %d bytes, see /proc/sys/kernel/keys/maxbytes: %w", size, err)
+}
+
+// keyctlEnvelope is an Item as stored in the payload of a key. Earlier
+// versions also stored the modification and expiration times, which are
+// ignored since the kernel keeps the expiry itself.
+type keyctlEnvelope struct {
+	Item
+}
+
+func keyctlEncode(envelope keyctlEnvelope) ([]byte, error) {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := append([]byte(keyctlEnvelopeMagic), keyctlEnvelopeVersion)
+	return append(payload, data...), nil
+}
+
+func keyctlDecode(name string, payload []byte) (keyctlEnvelope, error) {
+	if !bytes.HasPrefix(payload, []byte(keyctlEnvelopeMagic)) || len(payload) == len(keyctlEnvelopeMagic) {
+		return keyctlEnvelope{Item: Item{Key: name, Data: payload}}, nil
+	}
+
+	version := payload[len(keyctlEnvelopeMagic)]
+	if version != keyctlEnvelopeVersion {
+		return keyctlEnvelope{}, fmt.Errorf("unsupported keyctl payload version %d", version)
+	}
+
+	var envelope keyctlEnvelope
+	if err := json.Unmarshal(payload[len(keyctlEnvelopeMagic)+1:], &envelope); err != nil {
+		return keyctlEnvelope{}, fmt.Errorf("decoding keyctl payload failed: %v", err)
+	}
+	envelope.Key = name
+
+	return envelope, nil
+}
+
 type keyctlKeyring struct {
 	keyring int32
 	perm    uint32
+	timeout time.Duration
+	keytype string
 }
 
 func init() {
 	supportedBackends[KeyCtlBackend] = opener(func(cfg Config) (Keyring, error) {
-		keyring := keyctlKeyring{}
+		keyring := keyctlKeyring{timeout: cfg.KeyCtlTimeout, keytype: cfg.KeyCtlKeyType}
 		if cfg.KeyCtlPerm > 0 {
 			keyring.perm = cfg.KeyCtlPerm
 		}
 
+		switch keyring.keytype {
+		case "", "user", "logon", "big_key":
+		default:
+			return nil, fmt.Errorf("unsupported key type %q", keyring.keytype)
+		}
+
 		parent, err := getKeyringForScope(cfg.KeyCtlScope)
 		if err != nil {
 			return nil, fmt.Errorf("accessing %q keyring failed: %v", cfg.KeyCtlScope, err)
@@ -84,43 +230,310 @@ func init() {
 			keyring.keyring = namedKeyring
 		}
 
+		// The kernel doesn't let us change the expiry of the persistent keyring itself, so
+		// like the kernel does for it, the named keyring's expiry is renewed whenever it's opened
+		if cfg.KeyCtlScope == "persistent" && cfg.KeyCtlPersistentTimeout > 0 {
+			if cfg.ServiceName == "" {
+				return nil, errors.New("KeyCtlPersistentTimeout requires a ServiceName")
+			}
+			if err := keyctlSetTimeout(keyring.keyring, keyctlSeconds(cfg.KeyCtlPersistentTimeout)); err != nil {
+				return nil, fmt.Errorf("setting timeout of named %q keyring failed: %v", cfg.ServiceName, err)
+			}
+		}
+
 		return &keyring, nil
 	})
 }
 
-func (k *keyctlKeyring) Get(name string) (Item, error) {
-	key, err := keyctlSearch(k.keyring, "user", name)
-	if err != nil {
-		if errors.Is(err, syscall.ENOKEY) {
-			return Item{}, ErrKeyNotFound
+// types returns the key types items are stored as.
+func (k *keyctlKeyring) types() []string {
+	if k.keytype == "" {
+		return []string{"user", "big_key"}
+	}
+	return []string{k.keytype}
+}
+
+// find searches for a key of any of the types items are stored as, treating
+// expired and revoked keys as missing.
+func (k *keyctlKeyring) find(name string) (int32, error) {
+	for _, keytype := range k.types() {
+		key, err := k.lookup(keytype, name)
+		if err == nil {
+			return key, nil
 		}
-		return Item{}, err
+		if !keyctlIsMissing(err) {
+			return 0, err
+		}
+	}
+
+	return 0, ErrKeyNotFound
+}
+
+// lookup finds a key of a type linked from the keyring itself, as
+// KEYCTL_SEARCH would also find a key of the same name in a nested keyring.
+// Keys with slashes are also looked up as paths through nested keyrings, one
+// level at a time, the way Keys lists them.
+func (k *keyctlKeyring) lookup(keytype, name string) (int32, error) {
+	key, err := keyctlChild(k.keyring, keytype, name)
+	if !keyctlIsMissing(err) || !strings.Contains(name, "/") {
+		return key, err
 	}
-	// data, err := key.Get()
+
+	ring := k.keyring
+	segments := strings.Split(name, "/")
+	for _, segment := range segments[:len(segments)-1] {
+		if ring, err = keyctlChild(ring, "keyring", segment); err != nil {
+			return 0, err
+		}
+	}
+
+	return keyctlChild(ring, keytype, segments[len(segments)-1])
+}
+
+// keyctlIsMissing reports whether an error means the key is gone, including
+// searching for a key type this kernel doesn't have.
+func keyctlIsMissing(err error) bool {
+	return errors.Is(err, syscall.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) ||
+		errors.Is(err, unix.EKEYREVOKED) || errors.Is(err, syscall.ENODEV)
+}
+
+func (k *keyctlKeyring) read(key int32) ([]byte, error) {
 	data, err := keyctlRead(key)
+	if errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+		return nil, ErrKeyNotFound
+	} else if errors.Is(err, syscall.EOPNOTSUPP) {
+		// Key types like "logon" can't be read from userspace
+		return nil, ErrNotReadable
+	}
+
+	return data, err
+}
+
+func (k *keyctlKeyring) get(name string) (int32, keyctlEnvelope, error) {
+	key, err := k.find(name)
 	if err != nil {
-		return Item{}, err
+		return 0, keyctlEnvelope{}, err
 	}
 
-	item := Item{
-		Key:  name,
-		Data: data,
+	data, err := k.read(key)
+	if err != nil {
+		return 0, keyctlEnvelope{}, err
 	}
 
-	return item, nil
+	if chunks, ok := keyctlDecodeChunks(data); ok {
+		if data, err = k.readChunks(name, chunks); err != nil {
+			return 0, keyctlEnvelope{}, err
+		}
+	}
+
+	envelope, err := keyctlDecode(name, data)
+	return key, envelope, err
 }
 
-// GetMetadata for pass returns an error indicating that it's unsupported for this backend.
-// TODO: We can deliver metadata different from the defined ones (e.g. permissions, expire-time, etc).
-func (k *keyctlKeyring) GetMetadata(_ string) (Metadata, error) {
-	return Metadata{}, ErrMetadataNotSupported
+func (k *keyctlKeyring) readChunks(name string, chunks keyctlChunks) ([]byte, error) {
+	var data []byte
+	for i := 0; i < chunks.Count; i++ {
+		key, err := keyctlChild(k.keyring, "user", chunks.name(name, i))
+		if keyctlIsMissing(err) {
+			return nil, fmt.Errorf("chunk %d of %q is missing", i, name)
+		} else if err != nil {
+			return nil, err
+		}
+
+		chunk, err := k.read(key)
+		if err != nil {
+			return nil, fmt.Errorf("reading chunk %d of %q failed: %v", i, name, err)
+		}
+		data = append(data, chunk...)
+	}
+
+	return data, nil
+}
+
+func (k *keyctlKeyring) Get(name string) (Item, error) {
+	_, envelope, err := k.get(name)
+	if err != nil {
+		return Item{}, err
+	}
+
+	return envelope.Item, nil
 }
 
+// GetMetadata returns what the kernel knows about the key of an item: its
+// ownership, permissions and expiry. The payload isn't read, so the item only
+// has its key.
+func (k *keyctlKeyring) GetMetadata(name string) (Metadata, error) {
+	key, err := k.find(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	info, err := keyctlKeyInfo(key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	expiry, err := keyctlExpiry(key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return Metadata{
+		Item:           &Item{Key: name},
+		ExpirationTime: expiry,
+		KeyCtl:         &info,
+	}, nil
+}
+
+// Set stores items as keys of the configured type. By default they are "user"
+// keys, or "big_key" keys when they are too large, with kernels without big_key
+// getting the payload split over several "user" keys.
 func (k *keyctlKeyring) Set(item Item) error {
+	switch k.keytype {
+	case "logon":
+		// The kernel consumers of logon keys expect just the secret
+		_, err := k.add(k.keytype, item.Key, item.Data)
+		if errors.Is(err, syscall.EINVAL) && !strings.Contains(item.Key, ":") {
+			return fmt.Errorf("logon keys need a service prefix, e.g. \"service:%s\": %w", item.Key, err)
+		}
+		return err
+	case "":
+		return k.setAuto(item)
+	}
+
+	payload, err := k.encode(item)
+	if err != nil {
+		return err
+	}
+	if k.keytype == "user" && len(payload) > keyctlUserMaxPayload {
+		return fmt.Errorf("item of %d bytes is too large for a user key", len(payload))
+	}
+
+	_, err = k.add(k.keytype, item.Key, payload)
+	return err
+}
+
+func (k *keyctlKeyring) encode(item Item) ([]byte, error) {
+	return keyctlEncode(keyctlEnvelope{Item: item})
+}
+
+// setAuto stores an item as a "user" key, switching to "big_key" or chunks
+// when it is too large.
+func (k *keyctlKeyring) setAuto(item Item) error {
+	payload, err := k.encode(item)
+	if err != nil {
+		return err
+	}
+
+	oldChunks := k.chunks(item.Key)
+
+	keytype := "user"
+	if len(payload) <= keyctlUserMaxPayload {
+		_, err = k.add("user", item.Key, payload)
+	} else {
+		keytype = "big_key"
+		_, err = k.add(keytype, item.Key, payload)
+		if errors.Is(err, syscall.ENODEV) {
+			keytype = "user"
+			err = k.addChunks(item.Key, payload)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Clean up what the previous item was stored as
+	for _, t := range []string{"user", "big_key"} {
+		if t == keytype {
+			continue
+		}
+		if key, err := keyctlChild(k.keyring, t, item.Key); err == nil {
+			if err := k.destroy(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return k.removeChunks(item.Key, oldChunks)
+}
+
+// addChunks stores a payload split over a new generation of "user" keys,
+// then switches the key listing them over to it. If that fails, the chunks
+// written so far are destroyed and the previous item is left as it was.
+func (k *keyctlKeyring) addChunks(name string, payload []byte) error {
+	generation := make([]byte, 4)
+	if _, err := rand.Read(generation); err != nil {
+		return err
+	}
+	chunks := keyctlChunks{Generation: hex.EncodeToString(generation)}
+
+	size := keyctlChunkSize()
+	for offset := 0; offset < len(payload); offset += size {
+		end := offset + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if _, err := k.add("user", chunks.name(name, chunks.Count), payload[offset:end]); err != nil {
+			_ = k.removeChunks(name, chunks)
+			return fmt.Errorf("adding chunk %d failed: %w", chunks.Count, err)
+		}
+		chunks.Count++
+	}
+
+	if _, err := k.add("user", name, keyctlEncodeChunks(chunks)); err != nil {
+		_ = k.removeChunks(name, chunks)
+		return err
+	}
+
+	return nil
+}
+
+// chunks returns the chunks the stored item is split over, none if it isn't.
+func (k *keyctlKeyring) chunks(name string) keyctlChunks {
+	key, err := keyctlChild(k.keyring, "user", name)
+	if err != nil {
+		return keyctlChunks{}
+	}
+
+	data, err := keyctlRead(key)
+	if err != nil {
+		return keyctlChunks{}
+	}
+
+	chunks, _ := keyctlDecodeChunks(data)
+	return chunks
+}
+
+// removeChunks destroys chunks, carrying on past the ones that fail so that
+// as few as possible are left behind.
+func (k *keyctlKeyring) removeChunks(name string, chunks keyctlChunks) error {
+	var firstErr error
+	for i := 0; i < chunks.Count; i++ {
+		key, err := keyctlChild(k.keyring, "user", chunks.name(name, i))
+		if err == nil {
+			err = k.destroy(key)
+		}
+		if err != nil && !keyctlIsMissing(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// add creates or updates a key in the keyring with the configured permissions
+// and timeout.
+func (k *keyctlKeyring) add(keytype, name string, payload []byte) (int32, error) {
 	if k.perm == 0 {
 		// Keep the default permissions (alswrv-----v------------)
-		_, err := keyctlAdd(k.keyring, "user", item.Key, item.Data)
-		return err
+		key, err := keyctlAdd(k.keyring, keytype, name, payload)
+		if errors.Is(err, syscall.EDQUOT) {
+			return 0, keyctlQuotaError(len(name)+len(payload), err)
+		} else if err != nil {
+			return 0, err
+		}
+
+		return key, k.setTimeout(key)
 	}
 
 	// By default we loose possession of the key in anything above the session keyring.
@@ -128,58 +541,279 @@ func (k *keyctlKeyring) Set(item Item) error {
 	// cannot change the permissions without possessing the key. Therefore, create the
 	// key in the session keyring, change permissions and then link to the target
 	// keyring and unlink from the intermediate keyring again.
-	key, err := keyctlAdd(unix.KEY_SPEC_SESSION_KEYRING, "user", item.Key, item.Data)
-	if err != nil {
-		return fmt.Errorf("adding key to session failed: %v", err)
+	key, err := keyctlAdd(unix.KEY_SPEC_SESSION_KEYRING, keytype, name, payload)
+	if errors.Is(err, syscall.EDQUOT) {
+		return 0, keyctlQuotaError(len(name)+len(payload), err)
+	} else if err != nil {
+		return 0, fmt.Errorf("adding key to session failed: %w", err)
+	}
+
+	// The timeout has to be set while we still possess the key
+	if err := k.setTimeout(key); err != nil {
+		return 0, err
 	}
 
 	if err := keyctlSetperm(key, k.perm); err != nil {
-		return fmt.Errorf("setting permission 0x%x failed: %v", k.perm, err)
+		return 0, fmt.Errorf("setting permission 0x%x failed: %v", k.perm, err)
 	}
 
 	if err := keyctlLink(k.keyring, key); err != nil {
-		return fmt.Errorf("linking key to keyring failed: %v", err)
+		return 0, fmt.Errorf("linking key to keyring failed: %v", err)
 	}
 
 	if err := keyctlUnlink(unix.KEY_SPEC_SESSION_KEYRING, key); err != nil {
-		return fmt.Errorf("unlinking key from session failed: %v", err)
+		return 0, fmt.Errorf("unlinking key from session failed: %v", err)
+	}
+
+	return key, nil
+}
+
+func (k *keyctlKeyring) setTimeout(key int32) error {
+	if k.timeout <= 0 {
+		return nil
+	}
+
+	if err := keyctlSetTimeout(key, keyctlSeconds(k.timeout)); err != nil {
+		return fmt.Errorf("setting timeout of %v failed: %v", k.timeout, err)
 	}
 
 	return nil
 }
 
+// keyctlSeconds converts a duration to the whole seconds the kernel counts in,
+// rounding up so keys never expire early.
+func keyctlSeconds(d time.Duration) uint {
+	return uint((d + time.Second - 1) / time.Second)
+}
+
+// destroy invalidates a key, so it is destroyed rather than staying reachable
+// through links from other keyrings.
+func (k *keyctlKeyring) destroy(key int32) error {
+	err := keyctlInvalidate(key)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		// Kernels before 3.5 can't invalidate keys
+		return keyctlUnlink(k.keyring, key)
+	}
+
+	return err
+}
+
 func (k *keyctlKeyring) Remove(name string) error {
-	key, err := keyctlSearch(k.keyring, "user", name)
-	if err != nil {
+	chunks := k.chunks(name)
+
+	found := false
+	for _, keytype := range k.types() {
+		key, err := k.lookup(keytype, name)
+		if err != nil {
+			continue
+		}
+		if err := k.destroy(key); err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
 		return ErrKeyNotFound
 	}
 
-	return keyctlUnlink(k.keyring, key)
+	return k.removeChunks(name, chunks)
 }
 
+// Keys lists the items in the keyring, with the items in nested keyrings as
+// slash-separated paths. Entries that can't be described are left out, see List.
 func (k *keyctlKeyring) Keys() ([]string, error) {
-	results := []string{}
+	keys, skipped, err := k.List()
+	for _, s := range skipped {
+		debugf("Skipped key %d in %q: %v", s.ID, s.Path, s.Err)
+	}
+
+	return keys, err
+}
+
+// Close does nothing, the keys live in the kernel.
+func (k *keyctlKeyring) Close() error {
+	return nil
+}
 
-	data, err := keyctlRead(k.keyring)
+// KeyCtlSkippedKey is an entry of a kernel keyring that was left out of the
+// listing, e.g. because it was revoked, has expired or can't be viewed.
+type KeyCtlSkippedKey struct {
+	ID int32
+	// Path is the nested keyring the entry is linked from, "" for the top level
+	Path string
+	Err  error
+}
+
+// KeyCtlKeyring is implemented by the keyctl backend.
+type KeyCtlKeyring interface {
+	Keyring
+	// Lists the keys like Keys, along with the entries that were skipped
+	List() ([]string, []KeyCtlSkippedKey, error)
+	// Returns the ownership and permissions of the kernel key of an item
+	KeyInfo(key string) (KeyCtlKeyInfo, error)
+}
+
+// KeyInfo returns the ownership and permissions of the kernel key of an item,
+// including write-only keys such as "logon" keys.
+func (k *keyctlKeyring) KeyInfo(name string) (KeyCtlKeyInfo, error) {
+	key, err := k.find(name)
 	if err != nil {
-		return nil, fmt.Errorf("reading keyring failed: %v", err)
+		return KeyCtlKeyInfo{}, err
 	}
-	ids, err := keyctlConvertKeyBuffer(data)
+
+	return keyctlKeyInfo(key)
+}
+
+func keyctlKeyInfo(key int32) (KeyCtlKeyInfo, error) {
+	info, err := keyctlDescribe(key)
 	if err != nil {
-		return nil, fmt.Errorf("converting raw keylist failed: %v", err)
+		return KeyCtlKeyInfo{}, err
+	}
+
+	uid, err := strconv.Atoi(info["uid"])
+	if err != nil {
+		return KeyCtlKeyInfo{}, fmt.Errorf("parsing uid %q failed: %v", info["uid"], err)
+	}
+	gid, err := strconv.Atoi(info["gid"])
+	if err != nil {
+		return KeyCtlKeyInfo{}, fmt.Errorf("parsing gid %q failed: %v", info["gid"], err)
+	}
+	perm, err := strconv.ParseUint(info["perm"], 16, 32)
+	if err != nil {
+		return KeyCtlKeyInfo{}, fmt.Errorf("parsing permissions %q failed: %v", info["perm"], err)
+	}
+
+	return KeyCtlKeyInfo{ID: key, UID: uid, GID: gid, Perm: uint32(perm)}, nil
+}
+
+// keyctlTimeoutUnits are the units of the timeouts in /proc/keys.
+var keyctlTimeoutUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// keyctlExpiry returns when a key expires, zero if it doesn't. The kernel only
+// reports the time left in /proc/keys, in whole units of the largest of
+// seconds, minutes, hours, days or weeks that fits, so keys expire up to a unit
+// later than returned.
+func keyctlExpiry(key int32) (time.Time, error) {
+	now := time.Now()
+	data, err := os.ReadFile("/proc/keys")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	id := fmt.Sprintf("%08x", key)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != id {
+			continue
+		}
+
+		timeout := fields[3]
+		switch timeout {
+		case "perm":
+			return time.Time{}, nil
+		case "expd":
+			return time.Time{}, ErrKeyNotFound
+		}
+		unit, ok := keyctlTimeoutUnits[timeout[len(timeout)-1]]
+		n, err := strconv.Atoi(timeout[:len(timeout)-1])
+		if !ok || err != nil {
+			return time.Time{}, fmt.Errorf("parsing timeout %q failed", timeout)
+		}
+		return now.Add(time.Duration(n) * unit), nil
+	}
+
+	return time.Time{}, fmt.Errorf("key %d not found in /proc/keys", key)
+}
+
+// List returns the keys like Keys, along with the entries that were skipped.
+func (k *keyctlKeyring) List() ([]string, []KeyCtlSkippedKey, error) {
+	l := keyctlListing{keys: []string{}, visited: map[int32]bool{k.keyring: true}}
+
+	ids, err := keyctlKeyringIDs(k.keyring)
+	if err != nil {
+		return nil, nil, err
+	}
+	k.list(ids, "", &l)
+
+	return l.keys, l.skipped, nil
+}
+
+type keyctlListing struct {
+	keys    []string
+	skipped []KeyCtlSkippedKey
+	visited map[int32]bool
+}
+
+func (k *keyctlKeyring) list(ids []int32, path string, l *keyctlListing) {
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
 	}
 
+	for _, id := range ids {
+		info, err := keyctlDescribe(id)
+		if errors.Is(err, syscall.ENOKEY) {
+			// Removed keys stay linked until the kernel garbage collects them
+			continue
+		} else if err != nil {
+			l.skipped = append(l.skipped, KeyCtlSkippedKey{ID: id, Path: path, Err: err})
+			continue
+		}
+
+		name := info["description"]
+		switch {
+		case info["type"] == "keyring":
+			// The kernel prevents cycles, but a keyring can be linked more than once
+			if l.visited[id] {
+				continue
+			}
+			l.visited[id] = true
+
+			nested, err := keyctlKeyringIDs(id)
+			if err != nil {
+				l.skipped = append(l.skipped, KeyCtlSkippedKey{ID: id, Path: path, Err: err})
+				continue
+			}
+			k.list(nested, prefix+name, l)
+		case containsString(k.types(), info["type"]) && !strings.HasPrefix(name, keyctlChunkPrefix):
+			if !containsString(l.keys, prefix+name) {
+				l.keys = append(l.keys, prefix+name)
+			}
+		}
+	}
+}
+
+// KeyCtlServiceNames lists the named keyrings in a scope, which are the
+// ServiceNames in use there.
+func KeyCtlServiceNames(scope string) ([]string, error) {
+	ring, err := getKeyringForScope(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := keyctlKeyringIDs(ring)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
 	for _, id := range ids {
 		info, err := keyctlDescribe(id)
 		if err != nil {
-			return nil, err
+			continue
 		}
-		if info["type"] == "user" {
-			results = append(results, info["description"])
+		if info["type"] == "keyring" {
+			names = append(names, info["description"])
 		}
 	}
 
-	return results, nil
+	return names, nil
 }
 
 func (k *keyctlKeyring) createNamedKeyring(parent int32, name string) (int32, error) {
@@ -229,6 +863,10 @@ func getKeyringForScope(scope string) (int32, error) {
 		return int32(unix.KEY_SPEC_PROCESS_KEYRING), nil
 	case "thread":
 		return int32(unix.KEY_SPEC_THREAD_KEYRING), nil
+	case "persistent":
+		// Linking the persistent keyring to the session keyring gives us possession of it
+		id, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, unix.KEY_SPEC_SESSION_KEYRING, 0, 0)
+		return int32(id), err
 	}
 	return 0, fmt.Errorf("unknown scope %q", scope)
 }
@@ -268,6 +906,42 @@ func keyctlRead(id int32) ([]byte, error) {
 	}
 }
 
+// keyctlKeyringIDs returns the ids of the keys linked from a keyring.
+func keyctlKeyringIDs(ring int32) ([]int32, error) {
+	data, err := keyctlRead(ring)
+	if err != nil {
+		return nil, fmt.Errorf("reading keyring failed: %w", err)
+	}
+	ids, err := keyctlConvertKeyBuffer(data)
+	if err != nil {
+		return nil, fmt.Errorf("converting raw keylist failed: %v", err)
+	}
+
+	return ids, nil
+}
+
+// keyctlChild finds a key linked directly from a keyring. KEYCTL_SEARCH looks
+// at the keyring's own keys before those of nested keyrings, so a key it finds
+// that isn't linked from the keyring itself means there's no such key there.
+func keyctlChild(ring int32, keytype, name string) (int32, error) {
+	key, err := keyctlSearch(ring, keytype, name)
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err := keyctlKeyringIDs(ring)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if id == key {
+			return key, nil
+		}
+	}
+
+	return 0, syscall.ENOKEY
+}
+
 func keyctlDescribe(id int32) (map[string]string, error) {
 	description, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, int(id))
 	if err != nil {
@@ -312,6 +986,16 @@ func keyctlSetperm(id int32, perm uint32) error {
 	return unix.KeyctlSetperm(int(id), perm)
 }
 
+func keyctlSetTimeout(id int32, seconds uint) error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, int(id), int(seconds), 0, 0)
+	return err
+}
+
+func keyctlInvalidate(id int32) error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_INVALIDATE, int(id), 0, 0, 0)
+	return err
+}
+
 func keyctlConvertKeyBuffer(buffer []byte) ([]int32, error) {
 	if len(buffer)%4 != 0 {
 		return nil, fmt.Errorf("buffer size %d not a multiple of 4", len(buffer))
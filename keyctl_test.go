@@ -6,9 +6,15 @@ package keyring_test
 import (
 	"errors"
 	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/99designs/keyring"
 	"golang.org/x/sys/unix"
@@ -251,3 +257,489 @@ func TestKeyCtlListEmptyKeyring(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, keys, 0)
 }
+
+func TestKeyCtlSetPreservesItem(t *testing.T) {
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+	})
+	require.NoError(t, err)
+
+	item1 := keyring.Item{
+		Key:                         "test",
+		Data:                        []byte("loose lips sink ships"),
+		Label:                       "Ships",
+		Description:                 "A warning",
+		KeychainNotTrustApplication: true,
+		KeychainNotSynchronizable:   true,
+	}
+	require.NoError(t, kr.Set(item1))
+
+	item2, err := kr.Get("test")
+	require.NoError(t, err)
+	require.Equal(t, item1, item2)
+
+	require.NoError(t, kr.Remove("test"))
+}
+
+func TestKeyCtlGetRawPayload(t *testing.T) {
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+	})
+	require.NoError(t, err)
+
+	// Keys written by earlier versions or "keyctl add" hold just the data
+	ringparentID, err := keyring.GetKeyringIDForScope(ringparent)
+	require.NoError(t, err)
+	named, err := unix.KeyctlSearch(int(ringparentID), "keyring", ringname, 0)
+	require.NoError(t, err)
+	_, err = unix.AddKey("user", "legacy", []byte("loose lips sink ships"), named)
+	require.NoError(t, err)
+
+	item, err := kr.Get("legacy")
+	require.NoError(t, err)
+	require.Equal(t, keyring.Item{Key: "legacy", Data: []byte("loose lips sink ships")}, item)
+
+	require.NoError(t, kr.Remove("legacy"))
+}
+
+func TestKeyCtlTimeoutAndMetadata(t *testing.T) {
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+		KeyCtlPerm:      0x3f3f0000, // "alswrvalswrv------------"
+		KeyCtlTimeout:   time.Second,
+	})
+	require.NoError(t, err)
+
+	before := time.Now()
+	require.NoError(t, kr.Set(keyring.Item{Key: "test", Label: "Ships", Data: []byte("loose lips sink ships")}))
+
+	// The metadata comes from the kernel, without reading the payload
+	md, err := kr.GetMetadata("test")
+	require.NoError(t, err)
+	require.Equal(t, &keyring.Item{Key: "test"}, md.Item)
+	require.WithinDuration(t, before.Add(time.Second), md.ExpirationTime, time.Second)
+	require.NotNil(t, md.KeyCtl)
+	require.Equal(t, uint32(0x3f3f0000), md.KeyCtl.Perm)
+	require.Equal(t, unix.Getuid(), md.KeyCtl.UID)
+	require.Equal(t, unix.Getgid(), md.KeyCtl.GID)
+
+	info, err := kr.(keyring.KeyCtlKeyring).KeyInfo("test")
+	require.NoError(t, err)
+	require.Equal(t, *md.KeyCtl, info)
+
+	// Timeouts changed behind the keyring's back are reported, to the minute
+	// past a minute
+	_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, int(info.ID), 3600, 0, 0)
+	require.NoError(t, err)
+	md, err = kr.GetMetadata("test")
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), md.ExpirationTime, time.Minute)
+
+	_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, int(info.ID), 0, 0, 0)
+	require.NoError(t, err)
+	md, err = kr.GetMetadata("test")
+	require.NoError(t, err)
+	require.True(t, md.ExpirationTime.IsZero())
+
+	_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, int(info.ID), 1, 0, 0)
+	require.NoError(t, err)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	_, err = kr.Get("test")
+	require.ErrorIs(t, err, keyring.ErrKeyNotFound)
+	_, err = kr.GetMetadata("test")
+	require.ErrorIs(t, err, keyring.ErrKeyNotFound)
+}
+
+func TestKeyCtlRemoveInvalidatesKey(t *testing.T) {
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+	})
+	require.NoError(t, err)
+	require.NoError(t, kr.Set(keyring.Item{Key: "test", Data: []byte("loose lips sink ships")}))
+
+	// Link the key from a second keyring
+	ringparentID, err := keyring.GetKeyringIDForScope(ringparent)
+	require.NoError(t, err)
+	key, err := unix.KeyctlSearch(int(ringparentID), "user", "test", 0)
+	require.NoError(t, err)
+	_, err = unix.KeyctlInt(unix.KEYCTL_LINK, key, int(ringparentID), 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, kr.Remove("test"))
+
+	_, err = unix.KeyctlBuffer(unix.KEYCTL_READ, key, make([]byte, 64), 0)
+	require.Error(t, err, "key should no longer be readable through other links")
+}
+
+func TestKeyCtlSetLargeItem(t *testing.T) {
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+		KeyCtlPerm:      0x3f3f0000, // "alswrvalswrv------------"
+	})
+	require.NoError(t, err)
+
+	// Well above the limit of "user" keys
+	data := make([]byte, 80*1024)
+	rand.Read(data)
+
+	item1 := keyring.Item{Key: "big", Data: data}
+	require.NoError(t, kr.Set(item1))
+
+	item2, err := kr.Get("big")
+	require.NoError(t, err)
+	require.Equal(t, item1, item2)
+
+	keys, err := kr.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"big"}, keys)
+
+	// Replacing it with a small item leaves nothing else behind
+	item3 := keyring.Item{Key: "big", Data: []byte("small now")}
+	require.NoError(t, kr.Set(item3))
+
+	item4, err := kr.Get("big")
+	require.NoError(t, err)
+	require.Equal(t, item3, item4)
+
+	// Replacing a chunked item leaves only the new chunks
+	require.NoError(t, kr.Set(item1))
+	chunks := chunkKeys(t)
+	require.NotEmpty(t, chunks)
+	require.NoError(t, kr.Set(item1))
+	require.Len(t, chunkKeys(t), len(chunks))
+	require.NotEqual(t, chunks, chunkKeys(t))
+
+	require.NoError(t, kr.Remove("big"))
+
+	keys, err = kr.Keys()
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	require.Empty(t, chunkKeys(t), "chunks should be removed")
+}
+
+// chunkKeys returns the descriptions of the keys holding chunks in the named
+// keyring.
+func chunkKeys(t *testing.T) []string {
+	t.Helper()
+
+	ringparentID, err := keyring.GetKeyringIDForScope(ringparent)
+	require.NoError(t, err)
+	named, err := unix.KeyctlSearch(int(ringparentID), "keyring", ringname, 0)
+	require.NoError(t, err)
+
+	buf := make([]byte, 4096)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, named, buf, 0)
+	require.NoError(t, err)
+
+	var chunks []string
+	for i := 0; i+4 <= n && i+4 <= len(buf); i += 4 {
+		id := int(*(*int32)(unsafe.Pointer(&buf[i])))
+		description, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+		if err != nil {
+			continue
+		}
+		fields := strings.Split(description, ";")
+		if name := fields[len(fields)-1]; strings.HasPrefix(name, ".keyring-chunk:") {
+			chunks = append(chunks, name)
+		}
+	}
+
+	return chunks
+}
+
+// keyQuotaUsed returns the bytes of the key quota of the user in use.
+func keyQuotaUsed(t *testing.T) int {
+	t.Helper()
+
+	data, err := os.ReadFile("/proc/key-users")
+	require.NoError(t, err)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 5 && fields[0] == strconv.Itoa(os.Geteuid())+":" {
+			used, _, _ := strings.Cut(fields[4], "/")
+			n, err := strconv.Atoi(used)
+			require.NoError(t, err)
+			return n
+		}
+	}
+
+	return 0
+}
+
+// runAsNobody reruns a test as the nobody user, since root's keys have a
+// quota of their own, kernel/keys/root_maxbytes.
+func runAsNobody(t *testing.T, test string) {
+	t.Helper()
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	data, err := os.ReadFile(exe)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(filepath.Dir(dir), 0755))
+	require.NoError(t, os.Chmod(dir, 0755))
+	copied := filepath.Join(dir, "keyring.test")
+	require.NoError(t, os.WriteFile(copied, data, 0755))
+
+	cmd := exec.Command(copied, "-test.run=^"+test+"$", "-test.v")
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	out, err := cmd.CombinedOutput()
+	require.NoErrorf(t, err, "%s failed as nobody:\n%s", test, out)
+	if !strings.Contains(string(out), "--- PASS: "+test) {
+		t.Skipf("%s didn't run as nobody:\n%s", test, out)
+	}
+}
+
+func TestKeyCtlSetOverQuota(t *testing.T) {
+	if os.Geteuid() == 0 {
+		runAsNobody(t, "TestKeyCtlSetOverQuota")
+		return
+	}
+
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+	})
+	require.NoError(t, err)
+
+	quota, err := os.ReadFile("/proc/sys/kernel/keys/maxbytes")
+	require.NoError(t, err)
+	maxbytes, err := strconv.Atoi(strings.TrimSpace(string(quota)))
+	require.NoError(t, err)
+
+	// Larger than the quota, but small enough for chunks to be tried before
+	// running out
+	data := make([]byte, maxbytes*3/2)
+	if len(data) <= 32767 {
+		data = make([]byte, 40*1024)
+	}
+	rand.Read(data)
+
+	before := keyQuotaUsed(t)
+	err = kr.Set(keyring.Item{Key: "big", Data: data})
+	require.ErrorIs(t, err, syscall.EDQUOT)
+	require.Contains(t, err.Error(), "maxbytes")
+
+	// The chunks written before running out are destroyed, and the kernel
+	// gives back their quota in the background
+	require.Empty(t, chunkKeys(t))
+	require.Eventually(t, func() bool { return keyQuotaUsed(t) < before+maxbytes/4 }, 5*time.Second, 10*time.Millisecond)
+
+	_, err = kr.Get("big")
+	require.ErrorIs(t, err, keyring.ErrKeyNotFound)
+	require.NoError(t, kr.Set(keyring.Item{Key: "small", Data: []byte("loose lips sink ships")}))
+}
+
+func TestKeyCtlPersistentScope(t *testing.T) {
+	if _, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, unix.KEY_SPEC_SESSION_KEYRING, 0, 0); err != nil {
+		t.Skipf("persistent keyrings are not available: %v", err)
+	}
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends:         []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:             "persistent",
+		ServiceName:             ringname,
+		KeyCtlPersistentTimeout: time.Hour,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		persistent, err := keyring.GetKeyringIDForScope("persistent")
+		if err != nil {
+			return
+		}
+		named, err := unix.KeyctlSearch(int(persistent), "keyring", ringname, 0)
+		if err != nil {
+			return
+		}
+		_, _ = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, named, 0, 0, 0)
+	})
+
+	item1 := keyring.Item{Key: "test", Data: []byte("loose lips sink ships")}
+	require.NoError(t, kr.Set(item1))
+
+	item2, err := kr.Get("test")
+	require.NoError(t, err)
+	require.Equal(t, item1, item2)
+
+	require.NoError(t, kr.Remove("test"))
+}
+
+func TestKeyCtlLogonKeys(t *testing.T) {
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+		KeyCtlKeyType:   "logon",
+	})
+	require.NoError(t, err)
+
+	require.Error(t, kr.Set(keyring.Item{Key: "test", Data: []byte("loose lips sink ships")}))
+	require.NoError(t, kr.Set(keyring.Item{Key: "cifs:test", Data: []byte("loose lips sink ships")}))
+
+	_, err = kr.Get("cifs:test")
+	require.ErrorIs(t, err, keyring.ErrNotReadable)
+
+	md, err := kr.GetMetadata("cifs:test")
+	require.NoError(t, err)
+	require.Equal(t, "cifs:test", md.Key)
+	require.NotNil(t, md.KeyCtl)
+
+	keys, err := kr.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"cifs:test"}, keys)
+
+	// Keys of other types aren't part of this keyring
+	other, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+	})
+	require.NoError(t, err)
+	require.NoError(t, other.Set(keyring.Item{Key: "test", Data: []byte("don't foo the bar")}))
+
+	keys, err = kr.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"cifs:test"}, keys)
+
+	require.NoError(t, kr.Remove("cifs:test"))
+	_, err = kr.GetMetadata("cifs:test")
+	require.ErrorIs(t, err, keyring.ErrKeyNotFound)
+}
+
+func TestKeyCtlOpenFailWrongKeyType(t *testing.T) {
+	_, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     "user",
+		KeyCtlKeyType:   "keyring",
+	})
+	require.Error(t, err)
+}
+
+func TestKeyCtlListNestedAndSkipped(t *testing.T) {
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	kr, err := keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+	})
+	require.NoError(t, err)
+	require.NoError(t, kr.Set(keyring.Item{Key: "test", Data: []byte("loose lips sink ships")}))
+
+	ringparentID, err := keyring.GetKeyringIDForScope(ringparent)
+	require.NoError(t, err)
+	named, err := unix.KeyctlSearch(int(ringparentID), "keyring", ringname, 0)
+	require.NoError(t, err)
+
+	// A nested keyring and a revoked key
+	nested, err := unix.AddKey("keyring", "nested", nil, named)
+	require.NoError(t, err)
+	_, err = unix.AddKey("user", "foobar", []byte("don't foo the bar"), nested)
+	require.NoError(t, err)
+	revoked, err := unix.AddKey("user", "revoked", []byte("gone"), named)
+	require.NoError(t, err)
+	_, err = unix.KeyctlInt(unix.KEYCTL_REVOKE, revoked, 0, 0, 0)
+	require.NoError(t, err)
+
+	keys, err := kr.Keys()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"test", "nested/foobar"}, keys)
+
+	_, skipped, err := kr.(keyring.KeyCtlKeyring).List()
+	require.NoError(t, err)
+	require.Len(t, skipped, 1)
+	require.Equal(t, int32(revoked), skipped[0].ID)
+	require.ErrorIs(t, skipped[0].Err, unix.EKEYREVOKED)
+
+	item, err := kr.Get("nested/foobar")
+	require.NoError(t, err)
+	require.Equal(t, []byte("don't foo the bar"), item.Data)
+
+	// Only the path finds keys in nested keyrings
+	_, err = kr.Get("foobar")
+	require.ErrorIs(t, err, keyring.ErrKeyNotFound)
+	require.ErrorIs(t, kr.Remove("foobar"), keyring.ErrKeyNotFound)
+	require.NoError(t, kr.Set(keyring.Item{Key: "foobar", Data: []byte("foo the bar")}))
+	item, err = kr.Get("foobar")
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo the bar"), item.Data)
+	item, err = kr.Get("nested/foobar")
+	require.NoError(t, err)
+	require.Equal(t, []byte("don't foo the bar"), item.Data)
+	require.NoError(t, kr.Remove("foobar"))
+
+	require.NoError(t, kr.Remove("nested/foobar"))
+	_, err = kr.Get("nested/foobar")
+	require.ErrorIs(t, err, keyring.ErrKeyNotFound)
+}
+
+func TestKeyCtlServiceNames(t *testing.T) {
+	exists, err := doesNamedKeyringExist()
+	require.Falsef(t, exists, "ring %q already exists in scope %q", ringname, ringparent)
+	require.NoErrorf(t, err, "checking for ring %q in scope %q failed: %v", ringname, ringparent, err)
+	t.Cleanup(cleanupNamedKeyring)
+
+	_, err = keyring.Open(keyring.Config{
+		AllowedBackends: []keyring.BackendType{keyring.KeyCtlBackend},
+		KeyCtlScope:     ringparent,
+		ServiceName:     ringname,
+	})
+	require.NoError(t, err)
+
+	names, err := keyring.KeyCtlServiceNames(ringparent)
+	require.NoError(t, err)
+	require.Contains(t, names, ringname)
+}
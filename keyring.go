@@ -65,6 +65,9 @@ func Open(cfg Config) (Keyring, error) {
 			openBackend, err := opener(cfg)
 			if err != nil {
 				debugf("Failed backend %s: %s", backend, err)
+				if openBackend != nil {
+					_ = openBackend.Close()
+				}
 				continue
 			}
 			return openBackend, nil
@@ -93,6 +96,20 @@ type Item struct {
 type Metadata struct {
 	*Item
 	ModificationTime time.Time
+	// ExpirationTime is when the item expires, zero if it doesn't
+	ExpirationTime time.Time
+
+	// KeyCtl is the kernel key of the item, set by the keyctl backend only
+	KeyCtl *KeyCtlKeyInfo
+}
+
+// KeyCtlKeyInfo is the ownership and permissions of the kernel key an item
+// is stored as.
+type KeyCtlKeyInfo struct {
+	ID   int32
+	UID  int
+	GID  int
+	Perm uint32
 }
 
 // Keyring provides the uniform interface over the underlying backends.
@@ -107,6 +124,54 @@ type Keyring interface {
 	Remove(key string) error
 	// Provides a slice of all keys stored on the keyring
 	Keys() ([]string, error)
+	// Releases the sessions, handles and cached passwords held by the keyring
+	Close() error
+}
+
+// RecipientKeyring is implemented by backends that encrypt each item to a list
+// of public-key recipients rather than a single passphrase. Directories are
+// slash-separated key prefixes, with "" meaning the whole keyring.
+type RecipientKeyring interface {
+	Keyring
+	// Returns the recipients the item with the given key is encrypted to
+	Recipients(key string) ([]string, error)
+	// Sets the recipients for a directory and re-encrypts the items below it
+	SetRecipients(dir string, recipients []string) error
+	// Adds recipients to a directory and re-encrypts the items below it
+	AddRecipients(dir string, recipients ...string) error
+	// Removes recipients from a directory and re-encrypts the items below it
+	RemoveRecipients(dir string, recipients ...string) error
+	// Re-encrypts the items below a directory to their current recipients
+	Reencrypt(dir string) error
+}
+
+// Revision is a previous version of an item.
+type Revision struct {
+	ID      string
+	Time    time.Time
+	Message string
+}
+
+// HistoryKeyring is implemented by backends that keep previous versions of
+// items.
+type HistoryKeyring interface {
+	Keyring
+	// Returns the revisions of the item with the given key, newest first
+	History(key string) ([]Revision, error)
+	// Returns the item with the given key as it was at a revision
+	GetRevision(key string, revision string) (Item, error)
+}
+
+// Locker is implemented by backends that can be locked explicitly, after
+// which using the keyring needs the password again.
+type Locker interface {
+	Keyring
+	// Locks the keyring
+	Lock() error
+	// Unlocks the keyring, prompting for the password if needed
+	Unlock() error
+	// Reports whether the keyring is locked
+	IsLocked() (bool, error)
 }
 
 // ErrNoAvailImpl is returned by Open when a backend cannot be found.
@@ -122,6 +187,24 @@ var ErrMetadataNeedsCredentials = errors.New("The keyring backend requires crede
 // ErrMetadataNotSupported is returned when Metadata is not available for the backend.
 var ErrMetadataNotSupported = errors.New("The keyring backend does not support metadata access")
 
+// ErrIntegrity is returned when a backend detects that its storage has been
+// tampered with, e.g. items deleted, rolled back or swapped between keys.
+var ErrIntegrity = errors.New("The keyring failed an integrity check")
+
+// ErrNoSecretKey is returned when none of the secret keys needed to decrypt
+// an item are available.
+var ErrNoSecretKey = errors.New("No secret key is available to decrypt the item")
+
+// ErrBadPassphrase is returned when the passphrase of a secret key is wrong.
+var ErrBadPassphrase = errors.New("Bad passphrase")
+
+// ErrPromptCancelled is returned when the user cancels a passphrase prompt.
+var ErrPromptCancelled = errors.New("The passphrase prompt was cancelled")
+
+// ErrNotReadable is returned by Get for items stored write-only, such as
+// keyctl "logon" keys which only the kernel can read.
+var ErrNotReadable = errors.New("The item is write-only and cannot be read back from the keyring")
+
 var (
 	// Debug specifies whether to print debugging output.
 	Debug bool
@@ -4,16 +4,33 @@
 package keyring
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/godbus/dbus"
 )
 
-const (
-	dbusServiceName = "org.kde.kwalletd5"
-	dbusPath        = "/modules/kwalletd5"
-)
+// kwalletServices are the D-Bus names of kwalletd in Plasma 6 and 5, in order
+// of preference.
+var kwalletServices = []struct {
+	name string
+	path dbus.ObjectPath
+}{
+	{"org.kde.kwalletd6", "/modules/kwalletd6"},
+	{"org.kde.kwalletd5", "/modules/kwalletd5"},
+}
+
+// kwalletDefaultWallet is the wallet used when there is none yet.
+const kwalletDefaultWallet = "kdewallet"
+
+var errKWalletDisabled = errors.New("KWallet is disabled, it can be enabled in the KDE Wallet settings")
 
 func init() {
 	if os.Getenv("DISABLE_KWALLET") == "1" {
@@ -27,32 +44,62 @@ func init() {
 	}
 
 	supportedBackends[KWalletBackend] = opener(func(cfg Config) (Keyring, error) {
-		if cfg.ServiceName == "" {
-			cfg.ServiceName = "kdewallet"
+		conn, err := dbus.SessionBus()
+		if err != nil {
+			return nil, err
 		}
 
-		if cfg.KWalletAppID == "" {
-			cfg.KWalletAppID = "keyring"
-		}
+		return openKwallet(conn, cfg)
+	})
+}
 
-		if cfg.KWalletFolder == "" {
-			cfg.KWalletFolder = "keyring"
-		}
+// openKwallet opens the wallet with kwalletd on the bus.
+func openKwallet(conn *dbus.Conn, cfg Config) (Keyring, error) {
+	if cfg.KWalletAppID == "" {
+		cfg.KWalletAppID = "keyring"
+	}
 
-		wallet, err := newKwallet()
-		if err != nil {
+	if cfg.KWalletFolder == "" {
+		cfg.KWalletFolder = "keyring"
+	}
+
+	switch cfg.KWalletFormat {
+	case "":
+		cfg.KWalletFormat = KWalletFormatJSON
+	case KWalletFormatJSON, KWalletFormatNative:
+	default:
+		return nil, fmt.Errorf("unknown kwallet format %q", cfg.KWalletFormat)
+	}
+
+	wallet, err := newKwallet(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled, err := wallet.IsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, errKWalletDisabled
+	}
+
+	if cfg.ServiceName == "" {
+		if cfg.ServiceName, err = wallet.defaultWallet(); err != nil {
 			return nil, err
 		}
+	}
 
-		ring := &kwalletKeyring{
-			wallet: *wallet,
-			name:   cfg.ServiceName,
-			appID:  cfg.KWalletAppID,
-			folder: cfg.KWalletFolder,
-		}
+	ring := &kwalletKeyring{
+		wallet: *wallet,
+		handle: -1,
+		name:   cfg.ServiceName,
+		appID:  cfg.KWalletAppID,
+		folder: cfg.KWalletFolder,
+		format: cfg.KWalletFormat,
+	}
 
-		return ring, ring.openWallet()
-	})
+	return ring, ring.openWallet()
 }
 
 type kwalletKeyring struct {
@@ -61,8 +108,29 @@ type kwalletKeyring struct {
 	handle int32
 	appID  string
 	folder string
+	format string
 }
 
+// Types of wallet entries, as returned by entryType.
+const (
+	kwalletEntryUnknown  int32 = 0
+	kwalletEntryPassword int32 = 1
+	kwalletEntryStream   int32 = 2
+	kwalletEntryMap      int32 = 3
+)
+
+// Fields of the map entries holding the metadata of password entries.
+const (
+	kwalletMapLabel               = "label"
+	kwalletMapDescription         = "description"
+	kwalletMapNotTrustApplication = "keychain-not-trust-application"
+	kwalletMapNotSynchronizable   = "keychain-not-synchronizable"
+)
+
+// kwalletMetadataFolderSuffix is appended to the folder to name the folder of
+// the map entries.
+const kwalletMetadataFolderSuffix = ".metadata"
+
 func (k *kwalletKeyring) openWallet() error {
 	isOpen, err := k.wallet.IsOpen(k.handle)
 	if err != nil {
@@ -74,26 +142,117 @@ func (k *kwalletKeyring) openWallet() error {
 		if err != nil {
 			return err
 		}
+		// kwalletd returns -1 when it fails or the user refuses access
+		if handle < 0 {
+			return fmt.Errorf("Unable to open the wallet %q", k.name)
+		}
 		k.handle = handle
 	}
 
 	return nil
 }
 
+// Lock closes the wallet, also for other applications using it, so that it
+// has to be unlocked again.
+func (k *kwalletKeyring) Lock() error {
+	if err := k.wallet.CloseWallet(k.name, true); err != nil {
+		return err
+	}
+	k.handle = -1
+	return nil
+}
+
+// Close releases our handle of the wallet, which kwalletd closes once no
+// application uses it any more.
+func (k *kwalletKeyring) Close() error {
+	if k.handle < 0 {
+		return nil
+	}
+
+	if err := k.wallet.Close(k.handle, false, k.appID); err != nil {
+		return err
+	}
+	k.handle = -1
+
+	return nil
+}
+
+// Unlock opens the wallet, which prompts the user if it's closed.
+func (k *kwalletKeyring) Unlock() error {
+	return k.openWallet()
+}
+
+func (k *kwalletKeyring) IsLocked() (bool, error) {
+	isOpen, err := k.wallet.IsWalletOpen(k.name)
+	return !isOpen, err
+}
+
+// metadataFolder is the folder of the map entries holding the fields of
+// password entries other than the Data, as an entry can't be both.
+func (k *kwalletKeyring) metadataFolder() string {
+	return k.folder + kwalletMetadataFolderSuffix
+}
+
+func (k *kwalletKeyring) hasFolder(folder string) (bool, error) {
+	folders, err := k.wallet.FolderList(k.handle, k.appID)
+	if err != nil {
+		return false, err
+	}
+
+	return containsString(folders, folder), nil
+}
+
+// ensureFolder creates a folder if it doesn't exist yet.
+func (k *kwalletKeyring) ensureFolder(folder string) error {
+	exists, err := k.hasFolder(folder)
+	if err != nil || exists {
+		return err
+	}
+
+	created, err := k.wallet.CreateFolder(k.handle, folder, k.appID)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("Unable to create the folder %q in the wallet %q", folder, k.name)
+	}
+
+	return nil
+}
+
+// Get reads entries in either format, whichever the entry was stored in.
 func (k *kwalletKeyring) Get(key string) (Item, error) {
 	err := k.openWallet()
 	if err != nil {
 		return Item{}, err
 	}
 
-	data, err := k.wallet.ReadEntry(k.handle, k.folder, key, k.appID)
+	exists, err := k.wallet.HasEntry(k.handle, k.folder, key, k.appID)
 	if err != nil {
 		return Item{}, err
 	}
-	if len(data) == 0 {
+	if !exists {
 		return Item{}, ErrKeyNotFound
 	}
 
+	entryType, err := k.wallet.EntryType(k.handle, k.folder, key, k.appID)
+	if err != nil {
+		return Item{}, err
+	}
+
+	switch entryType {
+	case kwalletEntryPassword:
+		return k.getPassword(key)
+	case kwalletEntryStream, kwalletEntryUnknown:
+	default:
+		return Item{}, fmt.Errorf("The wallet entry %q is a map, which the keyring can't read", key)
+	}
+
+	data, err := k.wallet.ReadEntry(k.handle, k.folder, key, k.appID)
+	if err != nil {
+		return Item{}, err
+	}
+
 	item := Item{}
 	err = json.Unmarshal(data, &item)
 	if err != nil {
@@ -103,6 +262,32 @@ func (k *kwalletKeyring) Get(key string) (Item, error) {
 	return item, nil
 }
 
+func (k *kwalletKeyring) getPassword(key string) (Item, error) {
+	password, err := k.wallet.ReadPassword(k.handle, k.folder, key, k.appID)
+	if err != nil {
+		return Item{}, err
+	}
+
+	item := Item{Key: key, Data: []byte(password)}
+
+	hasMetadata, err := k.wallet.HasEntry(k.handle, k.metadataFolder(), key, k.appID)
+	if err != nil || !hasMetadata {
+		return item, err
+	}
+
+	metadata, err := k.wallet.ReadMap(k.handle, k.metadataFolder(), key, k.appID)
+	if err != nil {
+		return Item{}, err
+	}
+
+	item.Label = metadata[kwalletMapLabel]
+	item.Description = metadata[kwalletMapDescription]
+	item.KeychainNotTrustApplication = metadata[kwalletMapNotTrustApplication] == "true"
+	item.KeychainNotSynchronizable = metadata[kwalletMapNotSynchronizable] == "true"
+
+	return item, nil
+}
+
 // GetMetadata for kwallet returns an error indicating that it's unsupported
 // for this backend.
 //
@@ -119,6 +304,14 @@ func (k *kwalletKeyring) Set(item Item) error {
 		return err
 	}
 
+	if err = k.ensureFolder(k.folder); err != nil {
+		return err
+	}
+
+	if k.format == KWalletFormatNative {
+		return k.setPassword(item)
+	}
+
 	data, err := json.Marshal(item)
 	if err != nil {
 		return err
@@ -129,7 +322,53 @@ func (k *kwalletKeyring) Set(item Item) error {
 		return err
 	}
 
-	return nil
+	// the metadata of an earlier password entry is in the JSON now
+	return k.removeMetadata(item.Key)
+}
+
+func (k *kwalletKeyring) setPassword(item Item) error {
+	if !utf8.Valid(item.Data) {
+		return errors.New("The native kwallet format can't store binary data")
+	}
+
+	err := k.wallet.WritePassword(k.handle, k.folder, item.Key, string(item.Data), k.appID)
+	if err != nil {
+		return err
+	}
+
+	metadata := map[string]string{}
+	if item.Label != "" {
+		metadata[kwalletMapLabel] = item.Label
+	}
+	if item.Description != "" {
+		metadata[kwalletMapDescription] = item.Description
+	}
+	if item.KeychainNotTrustApplication {
+		metadata[kwalletMapNotTrustApplication] = "true"
+	}
+	if item.KeychainNotSynchronizable {
+		metadata[kwalletMapNotSynchronizable] = "true"
+	}
+
+	if len(metadata) == 0 {
+		return k.removeMetadata(item.Key)
+	}
+
+	if err = k.ensureFolder(k.metadataFolder()); err != nil {
+		return err
+	}
+
+	return k.wallet.WriteMap(k.handle, k.metadataFolder(), item.Key, metadata, k.appID)
+}
+
+// removeMetadata removes the map entry of a password entry, if there is one.
+func (k *kwalletKeyring) removeMetadata(key string) error {
+	exists, err := k.wallet.HasEntry(k.handle, k.metadataFolder(), key, k.appID)
+	if err != nil || !exists {
+		return err
+	}
+
+	return k.wallet.RemoveEntry(k.handle, k.metadataFolder(), key, k.appID)
 }
 
 func (k *kwalletKeyring) Remove(key string) error {
@@ -138,12 +377,20 @@ func (k *kwalletKeyring) Remove(key string) error {
 		return err
 	}
 
+	exists, err := k.wallet.HasEntry(k.handle, k.folder, key, k.appID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrKeyNotFound
+	}
+
 	err = k.wallet.RemoveEntry(k.handle, k.folder, key, k.appID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return k.removeMetadata(key)
 }
 
 func (k *kwalletKeyring) Keys() ([]string, error) {
@@ -152,6 +399,11 @@ func (k *kwalletKeyring) Keys() ([]string, error) {
 		return []string{}, err
 	}
 
+	exists, err := k.hasFolder(k.folder)
+	if err != nil || !exists {
+		return []string{}, err
+	}
+
 	entries, err := k.wallet.EntryList(k.handle, k.folder, k.appID)
 	if err != nil {
 		return []string{}, err
@@ -160,15 +412,27 @@ func (k *kwalletKeyring) Keys() ([]string, error) {
 	return entries, nil
 }
 
-func newKwallet() (*kwalletBinding, error) {
-	conn, err := dbus.SessionBus()
-	if err != nil {
+func newKwallet(conn *dbus.Conn) (*kwalletBinding, error) {
+	var running, activatable []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListNames", 0).Store(&running); err != nil {
 		return nil, err
 	}
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListActivatableNames", 0).Store(&activatable); err != nil {
+		return nil, err
+	}
+
+	for _, names := range [][]string{running, activatable} {
+		for _, service := range kwalletServices {
+			if containsString(names, service.name) {
+				debugf("Using %s", service.name)
+				return &kwalletBinding{
+					conn.Object(service.name, service.path),
+				}, nil
+			}
+		}
+	}
 
-	return &kwalletBinding{
-		conn.Object(dbusServiceName, dbusPath),
-	}, nil
+	return nil, errors.New("KWallet isn't available, neither kwalletd6 nor kwalletd5 is running")
 }
 
 // Dumb Dbus bindings for kwallet bindings with types.
@@ -176,6 +440,55 @@ type kwalletBinding struct {
 	dbus dbus.BusObject
 }
 
+// defaultWallet returns the wallet KDE uses for local passwords, the first
+// wallet if there's no such setting, or the default name if there are none yet.
+func (k *kwalletBinding) defaultWallet() (string, error) {
+	name, err := k.LocalWallet()
+	if err != nil || name != "" {
+		return name, err
+	}
+
+	wallets, err := k.Wallets()
+	if err != nil {
+		return "", err
+	}
+	if len(wallets) > 0 {
+		return wallets[0], nil
+	}
+
+	return kwalletDefaultWallet, nil
+}
+
+// method bool org.kde.KWallet.isEnabled()
+func (k *kwalletBinding) IsEnabled() (bool, error) {
+	call := k.dbus.Call("org.kde.KWallet.isEnabled", 0)
+	if call.Err != nil {
+		return false, call.Err
+	}
+
+	return call.Body[0].(bool), call.Err
+}
+
+// method QStringList org.kde.KWallet.wallets()
+func (k *kwalletBinding) Wallets() ([]string, error) {
+	call := k.dbus.Call("org.kde.KWallet.wallets", 0)
+	if call.Err != nil {
+		return []string{}, call.Err
+	}
+
+	return call.Body[0].([]string), call.Err
+}
+
+// method QString org.kde.KWallet.localWallet()
+func (k *kwalletBinding) LocalWallet() (string, error) {
+	call := k.dbus.Call("org.kde.KWallet.localWallet", 0)
+	if call.Err != nil {
+		return "", call.Err
+	}
+
+	return call.Body[0].(string), call.Err
+}
+
 // method bool org.kde.KWallet.isOpen(int handle)
 func (k *kwalletBinding) IsOpen(handle int32) (bool, error) {
 	call := k.dbus.Call("org.kde.KWallet.isOpen", 0, handle)
@@ -186,6 +499,16 @@ func (k *kwalletBinding) IsOpen(handle int32) (bool, error) {
 	return call.Body[0].(bool), call.Err
 }
 
+// method bool org.kde.KWallet.isOpen(QString wallet)
+func (k *kwalletBinding) IsWalletOpen(wallet string) (bool, error) {
+	call := k.dbus.Call("org.kde.KWallet.isOpen", 0, wallet)
+	if call.Err != nil {
+		return false, call.Err
+	}
+
+	return call.Body[0].(bool), call.Err
+}
+
 // method int org.kde.KWallet.open(QString wallet, qlonglong wId, QString appid)
 func (k *kwalletBinding) Open(name string, wID int64, appid string) (int32, error) {
 	call := k.dbus.Call("org.kde.KWallet.open", 0, name, wID, appid)
@@ -196,6 +519,26 @@ func (k *kwalletBinding) Open(name string, wID int64, appid string) (int32, erro
 	return call.Body[0].(int32), call.Err
 }
 
+// method int org.kde.KWallet.close(int handle, bool force, QString appid)
+func (k *kwalletBinding) Close(handle int32, force bool, appid string) error {
+	call := k.dbus.Call("org.kde.KWallet.close", 0, handle, force, appid)
+	if call.Err != nil {
+		return call.Err
+	}
+
+	return call.Err
+}
+
+// method int org.kde.KWallet.close(QString wallet, bool force)
+func (k *kwalletBinding) CloseWallet(wallet string, force bool) error {
+	call := k.dbus.Call("org.kde.KWallet.close", 0, wallet, force)
+	if call.Err != nil {
+		return call.Err
+	}
+
+	return call.Err
+}
+
 // method QStringList org.kde.KWallet.entryList(int handle, QString folder, QString appid)
 func (k *kwalletBinding) EntryList(handle int32, folder string, appid string) ([]string, error) {
 	call := k.dbus.Call("org.kde.KWallet.entryList", 0, handle, folder, appid)
@@ -213,7 +556,7 @@ func (k *kwalletBinding) WriteEntry(handle int32, folder string, key string, val
 		return call.Err
 	}
 
-	return call.Err
+	return kwalletResult(call, "write", key)
 }
 
 // method int org.kde.KWallet.removeEntry(int handle, QString folder, QString key, QString appid)
@@ -223,7 +566,7 @@ func (k *kwalletBinding) RemoveEntry(handle int32, folder string, key string, ap
 		return call.Err
 	}
 
-	return call.Err
+	return kwalletResult(call, "remove", key)
 }
 
 // method QByteArray org.kde.KWallet.readEntry(int handle, QString folder, QString key, QString appid)
@@ -235,3 +578,167 @@ func (k *kwalletBinding) ReadEntry(handle int32, folder string, key string, appi
 
 	return call.Body[0].([]byte), call.Err
 }
+
+// method QStringList org.kde.KWallet.folderList(int handle, QString appid)
+func (k *kwalletBinding) FolderList(handle int32, appid string) ([]string, error) {
+	call := k.dbus.Call("org.kde.KWallet.folderList", 0, handle, appid)
+	if call.Err != nil {
+		return []string{}, call.Err
+	}
+
+	return call.Body[0].([]string), call.Err
+}
+
+// method bool org.kde.KWallet.createFolder(int handle, QString folder, QString appid)
+func (k *kwalletBinding) CreateFolder(handle int32, folder string, appid string) (bool, error) {
+	call := k.dbus.Call("org.kde.KWallet.createFolder", 0, handle, folder, appid)
+	if call.Err != nil {
+		return false, call.Err
+	}
+
+	return call.Body[0].(bool), call.Err
+}
+
+// method bool org.kde.KWallet.hasEntry(int handle, QString folder, QString key, QString appid)
+func (k *kwalletBinding) HasEntry(handle int32, folder string, key string, appid string) (bool, error) {
+	call := k.dbus.Call("org.kde.KWallet.hasEntry", 0, handle, folder, key, appid)
+	if call.Err != nil {
+		return false, call.Err
+	}
+
+	return call.Body[0].(bool), call.Err
+}
+
+// method int org.kde.KWallet.entryType(int handle, QString folder, QString key, QString appid)
+func (k *kwalletBinding) EntryType(handle int32, folder string, key string, appid string) (int32, error) {
+	call := k.dbus.Call("org.kde.KWallet.entryType", 0, handle, folder, key, appid)
+	if call.Err != nil {
+		return kwalletEntryUnknown, call.Err
+	}
+
+	return call.Body[0].(int32), call.Err
+}
+
+// method QString org.kde.KWallet.readPassword(int handle, QString folder, QString key, QString appid)
+func (k *kwalletBinding) ReadPassword(handle int32, folder string, key string, appid string) (string, error) {
+	call := k.dbus.Call("org.kde.KWallet.readPassword", 0, handle, folder, key, appid)
+	if call.Err != nil {
+		return "", call.Err
+	}
+
+	return call.Body[0].(string), call.Err
+}
+
+// method int org.kde.KWallet.writePassword(int handle, QString folder, QString key, QString value, QString appid)
+func (k *kwalletBinding) WritePassword(handle int32, folder string, key string, value string, appid string) error {
+	call := k.dbus.Call("org.kde.KWallet.writePassword", 0, handle, folder, key, value, appid)
+	if call.Err != nil {
+		return call.Err
+	}
+
+	return kwalletResult(call, "write", key)
+}
+
+// method QByteArray org.kde.KWallet.readMap(int handle, QString folder, QString key, QString appid)
+func (k *kwalletBinding) ReadMap(handle int32, folder string, key string, appid string) (map[string]string, error) {
+	call := k.dbus.Call("org.kde.KWallet.readMap", 0, handle, folder, key, appid)
+	if call.Err != nil {
+		return nil, call.Err
+	}
+
+	return kwalletDecodeMap(call.Body[0].([]byte))
+}
+
+// method int org.kde.KWallet.writeMap(int handle, QString folder, QString key, QByteArray value, QString appid)
+func (k *kwalletBinding) WriteMap(handle int32, folder string, key string, value map[string]string, appid string) error {
+	call := k.dbus.Call("org.kde.KWallet.writeMap", 0, handle, folder, key, kwalletEncodeMap(value), appid)
+	if call.Err != nil {
+		return call.Err
+	}
+
+	return kwalletResult(call, "write", key)
+}
+
+// kwalletResult checks the int result of methods changing entries, which is
+// 0 on success.
+func kwalletResult(call *dbus.Call, action string, key string) error {
+	if rc, ok := call.Body[0].(int32); ok && rc != 0 {
+		return fmt.Errorf("Unable to %s the wallet entry %q", action, key)
+	}
+
+	return nil
+}
+
+// kwalletEncodeMap serializes a map like a QMap<QString, QString> written to
+// a QDataStream, which is how map entries are sent over D-Bus.
+func kwalletEncodeMap(m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(m)))
+	for _, k := range keys {
+		kwalletEncodeString(&buf, k)
+		kwalletEncodeString(&buf, m[k])
+	}
+
+	return buf.Bytes()
+}
+
+// kwalletEncodeString serializes a QString: its length in bytes followed by
+// UTF-16 big-endian code units.
+func kwalletEncodeString(buf *bytes.Buffer, s string) {
+	units := utf16.Encode([]rune(s))
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(units)*2))
+	_ = binary.Write(buf, binary.BigEndian, units)
+}
+
+// kwalletDecodeMap reads a map serialized by kwalletEncodeMap.
+func kwalletDecodeMap(data []byte) (map[string]string, error) {
+	r := bytes.NewReader(data)
+
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("Invalid wallet map entry: %w", err)
+	}
+
+	m := map[string]string{}
+	for i := uint32(0); i < count; i++ {
+		key, err := kwalletDecodeString(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := kwalletDecodeString(r)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = value
+	}
+
+	return m, nil
+}
+
+func kwalletDecodeString(r *bytes.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", fmt.Errorf("Invalid wallet map entry: %w", err)
+	}
+
+	// a null QString
+	if length == 0xffffffff {
+		return "", nil
+	}
+	if length%2 != 0 || int64(length) > int64(r.Len()) {
+		return "", errors.New("Invalid wallet map entry: bad string length")
+	}
+
+	units := make([]uint16, length/2)
+	if err := binary.Read(r, binary.BigEndian, units); err != nil {
+		return "", fmt.Errorf("Invalid wallet map entry: %w", err)
+	}
+
+	return string(utf16.Decode(units)), nil
+}
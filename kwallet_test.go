@@ -0,0 +1,341 @@
+//go:build linux
+// +build linux
+
+package keyring
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// kwalletSetup opens a keyring with a fake kwalletd6 on a private bus.
+func kwalletSetup(t *testing.T, cfg Config) (*fakeKWallet, *kwalletKeyring) {
+	t.Helper()
+
+	fake, conn := newFakeKWallet(t, "org.kde.kwalletd6", "/modules/kwalletd6")
+	kr, err := openKwallet(conn, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, kr.(*kwalletKeyring)
+}
+
+func TestKWalletKeysWhenEmpty(t *testing.T) {
+	_, kr := kwalletSetup(t, Config{ServiceName: "kdewallet"})
+
+	keys, err := kr.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Expected 0 keys, got %d", len(keys))
+	}
+}
+
+func TestKWalletGetAndRemoveWhenEmpty(t *testing.T) {
+	_, kr := kwalletSetup(t, Config{ServiceName: "kdewallet"})
+
+	if _, err := kr.Get("llamas"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got: %v", err)
+	}
+	if err := kr.Remove("llamas"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got: %v", err)
+	}
+}
+
+func TestKWalletSetGetRemove(t *testing.T) {
+	fake, kr := kwalletSetup(t, Config{ServiceName: "kdewallet"})
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great"), Label: "Llamas"}
+	item2 := Item{Key: "alpacas", Data: []byte("alpacas are better")}
+	for _, i := range []Item{item, item2} {
+		if err := kr.Set(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it, err := kr.Get(item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(it, item) {
+		t.Fatalf("Expected %#v, got %#v", item, it)
+	}
+
+	// The item is stored as JSON, as earlier versions did
+	entryType, value, _ := fake.Entry("kdewallet", "keyring", "llamas")
+	if entryType != kwalletEntryStream || !json.Valid(value) {
+		t.Fatalf("Expected a JSON stream entry, got type %d: %q", entryType, value)
+	}
+
+	keys, err := kr.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"alpacas", "llamas"}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+
+	if err := kr.Remove(item.Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.Get(item.Key); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got: %v", err)
+	}
+}
+
+func TestKWalletNativeFormat(t *testing.T) {
+	fake, kr := kwalletSetup(t, Config{ServiceName: "kdewallet", KWalletFormat: KWalletFormatNative})
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great"), Label: "Llamas", Description: "The best animals"}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := kr.Get(item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(it, item) {
+		t.Fatalf("Expected %#v, got %#v", item, it)
+	}
+
+	// Other KDE applications see a password, and the fields as a map
+	entryType, value, _ := fake.Entry("kdewallet", "keyring", "llamas")
+	if entryType != kwalletEntryPassword || string(value) != "llamas are great" {
+		t.Fatalf("Expected a password entry, got type %d: %q", entryType, value)
+	}
+	entryType, value, _ = fake.Entry("kdewallet", "keyring.metadata", "llamas")
+	metadata, err := kwalletDecodeMap(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entryType != kwalletEntryMap || metadata["label"] != "Llamas" || metadata["description"] != "The best animals" {
+		t.Fatalf("Expected a map entry, got type %d: %v", entryType, metadata)
+	}
+
+	// The map goes away with the fields
+	item = Item{Key: "llamas", Data: []byte("llamas are great")}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := fake.Entry("kdewallet", "keyring.metadata", "llamas"); ok {
+		t.Fatal("Expected the map entry to be removed")
+	}
+
+	if err := kr.Set(Item{Key: "binary", Data: []byte{0xff, 0xfe}}); err == nil {
+		t.Fatal("Expected binary data to be refused")
+	}
+
+	if err := kr.Remove(item.Key); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := kr.Keys(); len(keys) != 0 {
+		t.Fatalf("Expected 0 keys, got %v", keys)
+	}
+}
+
+func TestKWalletReadsEitherFormat(t *testing.T) {
+	_, kr := kwalletSetup(t, Config{ServiceName: "kdewallet"})
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great"), Description: "The best animals"}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	kr.format = KWalletFormatNative
+	it, err := kr.Get(item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(it, item) {
+		t.Fatalf("Expected %#v, got %#v", item, it)
+	}
+
+	item2 := Item{Key: "alpacas", Data: []byte("alpacas are better"), Description: "Fluffier"}
+	if err := kr.Set(item2); err != nil {
+		t.Fatal(err)
+	}
+
+	kr.format = KWalletFormatJSON
+	it, err = kr.Get(item2.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(it, item2) {
+		t.Fatalf("Expected %#v, got %#v", item2, it)
+	}
+}
+
+func TestKWalletWrongFormat(t *testing.T) {
+	_, conn := newFakeKWallet(t, "org.kde.kwalletd6", "/modules/kwalletd6")
+
+	if _, err := openKwallet(conn, Config{KWalletFormat: "yaml"}); err == nil {
+		t.Fatal("Expected an unknown format to fail")
+	}
+}
+
+func TestKWalletOpenDenied(t *testing.T) {
+	fake, conn := newFakeKWallet(t, "org.kde.kwalletd6", "/modules/kwalletd6")
+	fake.Configure(func(k *fakeKWallet) { k.DenyOpen = true })
+
+	kr, err := openKwallet(conn, Config{ServiceName: "kdewallet"})
+	if err == nil || !strings.Contains(err.Error(), "Unable to open") {
+		t.Fatalf("Expected the open to fail, got: %v", err)
+	}
+	if err := kr.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKWalletDisabled(t *testing.T) {
+	fake, conn := newFakeKWallet(t, "org.kde.kwalletd6", "/modules/kwalletd6")
+	fake.Configure(func(k *fakeKWallet) { k.Disabled = true })
+
+	if _, err := openKwallet(conn, Config{}); !errors.Is(err, errKWalletDisabled) {
+		t.Fatalf("Expected errKWalletDisabled, got: %v", err)
+	}
+	if n := fake.CallCount("open"); n != 0 {
+		t.Fatalf("Expected no wallet to be opened, got %d calls", n)
+	}
+}
+
+func TestKWalletDetectsKwalletd5(t *testing.T) {
+	fake, conn := newFakeKWallet(t, "org.kde.kwalletd5", "/modules/kwalletd5")
+
+	kr, err := openKwallet(conn, Config{ServiceName: "kdewallet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kr.Close()
+	if !fake.IsOpen("kdewallet") {
+		t.Fatal("Expected the wallet to be opened by kwalletd5")
+	}
+
+	// Nothing to talk to
+	address := startTestBus(t)
+	if _, err := newKwallet(dialTestBus(t, address)); err == nil {
+		t.Fatal("Expected no kwalletd to be found")
+	}
+}
+
+func TestKWalletDefaultWallet(t *testing.T) {
+	fake, conn := newFakeKWallet(t, "org.kde.kwalletd6", "/modules/kwalletd6")
+
+	open := func() string {
+		t.Helper()
+		kr, err := openKwallet(conn, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kr.Close()
+		return kr.(*kwalletKeyring).name
+	}
+
+	// There are no wallets yet
+	if name := open(); name != "kdewallet" {
+		t.Fatalf("Expected kdewallet, got %q", name)
+	}
+
+	// The first of the wallets
+	fake.AddWallet("a-wallet")
+	if name := open(); name != "a-wallet" {
+		t.Fatalf("Expected a-wallet, got %q", name)
+	}
+
+	// The wallet for local passwords
+	fake.AddWallet("work")
+	fake.Configure(func(k *fakeKWallet) { k.Local = "work" })
+	if name := open(); name != "work" {
+		t.Fatalf("Expected work, got %q", name)
+	}
+}
+
+func TestKWalletLock(t *testing.T) {
+	fake, kr := kwalletSetup(t, Config{ServiceName: "kdewallet"})
+
+	var l Locker = kr
+	if locked, err := l.IsLocked(); err != nil || locked {
+		t.Fatalf("Expected the wallet to be open, got %v, %v", locked, err)
+	}
+
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if fake.IsOpen("kdewallet") {
+		t.Fatal("Expected the wallet to be closed")
+	}
+	if locked, err := l.IsLocked(); err != nil || !locked {
+		t.Fatalf("Expected the wallet to be locked, got %v, %v", locked, err)
+	}
+
+	// Using the keyring opens the wallet again
+	if err := kr.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.IsOpen("kdewallet") {
+		t.Fatal("Expected the wallet to be open")
+	}
+}
+
+func TestKWalletClose(t *testing.T) {
+	fake, kr := kwalletSetup(t, Config{ServiceName: "kdewallet"})
+
+	if err := kr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.CallCount("close"); n != 1 {
+		t.Fatalf("Expected the handle to be closed, got %d calls", n)
+	}
+	if !fake.IsOpen("kdewallet") {
+		t.Fatal("Expected the wallet to stay open for other applications")
+	}
+
+	if err := kr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.CallCount("close"); n != 1 {
+		t.Fatalf("Expected closing twice to do nothing, got %d calls", n)
+	}
+}
+
+func TestKWalletMapEncoding(t *testing.T) {
+	// QDataStream of a QMap<QString, QString>{"a": "b"}
+	encoded := kwalletEncodeMap(map[string]string{"a": "b"})
+	expected := []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 'a', 0, 0, 0, 2, 0, 'b'}
+	if !bytes.Equal(encoded, expected) {
+		t.Fatalf("Expected %x, got %x", expected, encoded)
+	}
+
+	m := map[string]string{
+		"label":       "Llamas 🦙",
+		"description": "",
+	}
+	decoded, err := kwalletDecodeMap(kwalletEncodeMap(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, m) {
+		t.Fatalf("Expected %v, got %v", m, decoded)
+	}
+
+	// null strings, as written by Qt for QString()
+	decoded, err = kwalletDecodeMap([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 'a', 0xff, 0xff, 0xff, 0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, map[string]string{"a": ""}) {
+		t.Fatalf("Unexpected map %v", decoded)
+	}
+
+	if _, err := kwalletDecodeMap([]byte{0, 0, 0, 1, 0, 0, 0, 8, 0, 'a'}); err == nil {
+		t.Fatal("Expected truncated maps to fail")
+	}
+}
@@ -0,0 +1,340 @@
+//go:build linux
+// +build linux
+
+package keyring
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus"
+)
+
+// A kwalletd for tests, keeping wallets in memory. It is served on a private
+// bus, see startTestBus.
+//
+// kwalletd overloads methods such as isOpen and close by their arguments,
+// which exported Go methods can't, so calls are dispatched by fakeKWallet.call
+// through a dbus.Handler of its own.
+
+type fakeKWalletEntry struct {
+	entryType int32
+	value     []byte
+}
+
+type fakeKWalletWallet struct {
+	open    bool
+	folders map[string]map[string]fakeKWalletEntry
+}
+
+type fakeKWallet struct {
+	mu      sync.Mutex
+	wallets map[string]*fakeKWalletWallet
+	handles map[int32]string
+	counter int32
+
+	// Scriptable behaviour, see Configure
+
+	// Disabled disables the wallet subsystem
+	Disabled bool
+	// DenyOpen makes the user refuse to open wallets
+	DenyOpen bool
+	// Local is the wallet set up for local passwords
+	Local string
+
+	// Calls counts the method calls received, by method name
+	Calls map[string]int
+}
+
+// newFakeKWallet serves a fake kwalletd with a D-Bus name such as
+// org.kde.kwalletd6 on a new private bus, returning it and a client
+// connection to the bus.
+func newFakeKWallet(t *testing.T, name string, path dbus.ObjectPath) (*fakeKWallet, *dbus.Conn) {
+	t.Helper()
+
+	k := &fakeKWallet{
+		wallets: map[string]*fakeKWalletWallet{},
+		handles: map[int32]string{},
+		Calls:   map[string]int{},
+	}
+
+	address := startTestBus(t)
+	conn := dialTestBus(t, address, dbus.WithHandler(fakeKWalletHandler{k, path}))
+
+	reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("Unable to own %s", name)
+	}
+
+	return k, dialTestBus(t, address)
+}
+
+// AddWallet adds a wallet, which is closed.
+func (k *fakeKWallet) AddWallet(name string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.wallets[name] = &fakeKWalletWallet{folders: map[string]map[string]fakeKWalletEntry{}}
+}
+
+// Entry returns an entry of a wallet, with ok false if there's no such entry.
+func (k *fakeKWallet) Entry(wallet, folder, key string) (entryType int32, value []byte, ok bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	w, ok := k.wallets[wallet]
+	if !ok {
+		return 0, nil, false
+	}
+	e, ok := w.folders[folder][key]
+
+	return e.entryType, e.value, ok
+}
+
+// IsOpen reports whether a wallet is open.
+func (k *fakeKWallet) IsOpen(wallet string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	w, ok := k.wallets[wallet]
+	return ok && w.open
+}
+
+// Configure changes the scriptable behaviour.
+func (k *fakeKWallet) Configure(f func(k *fakeKWallet)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	f(k)
+}
+
+// CallCount returns how often a method was called.
+func (k *fakeKWallet) CallCount(method string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.Calls[method]
+}
+
+// wallet returns the open wallet of a handle.
+func (k *fakeKWallet) wallet(handle int32) *fakeKWalletWallet {
+	name, ok := k.handles[handle]
+	if !ok {
+		return nil
+	}
+
+	return k.wallets[name]
+}
+
+// entries returns the entries of a folder of the open wallet of a handle, nil
+// if either doesn't exist.
+func (k *fakeKWallet) entries(handle int32, folder string) map[string]fakeKWalletEntry {
+	w := k.wallet(handle)
+	if w == nil {
+		return nil
+	}
+
+	return w.folders[folder]
+}
+
+func (k *fakeKWallet) closeWallet(name string) {
+	for handle, wallet := range k.handles {
+		if wallet == name {
+			delete(k.handles, handle)
+		}
+	}
+	if w, ok := k.wallets[name]; ok {
+		w.open = false
+	}
+}
+
+func (k *fakeKWallet) write(args []interface{}, entryType int32, value []byte) int32 {
+	entries := k.entries(args[0].(int32), args[1].(string))
+	if entries == nil {
+		return -1
+	}
+	entries[args[2].(string)] = fakeKWalletEntry{entryType: entryType, value: value}
+
+	return 0
+}
+
+func (k *fakeKWallet) read(args []interface{}, entryType int32) []byte {
+	e, ok := k.entries(args[0].(int32), args[1].(string))[args[2].(string)]
+	if !ok || e.entryType != entryType {
+		return []byte{}
+	}
+
+	return e.value
+}
+
+// call implements the methods of org.kde.KWallet used by the keyring, with
+// the signatures of kwalletd.
+func (k *fakeKWallet) call(method string, args []interface{}) (interface{}, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.Calls[method]++
+
+	switch method {
+	case "isEnabled":
+		return !k.Disabled, nil
+
+	case "wallets":
+		wallets := []string{}
+		for name := range k.wallets {
+			wallets = append(wallets, name)
+		}
+		sort.Strings(wallets)
+		return wallets, nil
+
+	case "localWallet":
+		return k.Local, nil
+
+	case "open":
+		if k.Disabled || k.DenyOpen {
+			return int32(-1), nil
+		}
+		name := args[0].(string)
+		w, ok := k.wallets[name]
+		if !ok {
+			w = &fakeKWalletWallet{folders: map[string]map[string]fakeKWalletEntry{}}
+			k.wallets[name] = w
+		}
+		w.open = true
+		k.counter++
+		k.handles[k.counter] = name
+		return k.counter, nil
+
+	case "isOpen":
+		switch arg := args[0].(type) {
+		case int32:
+			return k.wallet(arg) != nil, nil
+		case string:
+			w, ok := k.wallets[arg]
+			return ok && w.open, nil
+		}
+
+	case "close":
+		switch arg := args[0].(type) {
+		case int32:
+			name, ok := k.handles[arg]
+			if !ok {
+				return int32(-1), nil
+			}
+			delete(k.handles, arg)
+			if args[1].(bool) {
+				k.closeWallet(name)
+			}
+			return int32(0), nil
+		case string:
+			k.closeWallet(arg)
+			return int32(0), nil
+		}
+
+	case "folderList":
+		folders := []string{}
+		if w := k.wallet(args[0].(int32)); w != nil {
+			for name := range w.folders {
+				folders = append(folders, name)
+			}
+		}
+		sort.Strings(folders)
+		return folders, nil
+
+	case "createFolder":
+		w := k.wallet(args[0].(int32))
+		if w == nil {
+			return false, nil
+		}
+		if _, ok := w.folders[args[1].(string)]; !ok {
+			w.folders[args[1].(string)] = map[string]fakeKWalletEntry{}
+		}
+		return true, nil
+
+	case "entryList":
+		keys := []string{}
+		for key := range k.entries(args[0].(int32), args[1].(string)) {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys, nil
+
+	case "hasEntry":
+		_, ok := k.entries(args[0].(int32), args[1].(string))[args[2].(string)]
+		return ok, nil
+
+	case "entryType":
+		return k.entries(args[0].(int32), args[1].(string))[args[2].(string)].entryType, nil
+
+	case "removeEntry":
+		entries := k.entries(args[0].(int32), args[1].(string))
+		if entries == nil {
+			return int32(-1), nil
+		}
+		delete(entries, args[2].(string))
+		return int32(0), nil
+
+	case "readEntry":
+		return k.read(args, kwalletEntryStream), nil
+	case "writeEntry":
+		return k.write(args, kwalletEntryStream, args[3].([]byte)), nil
+
+	case "readPassword":
+		return string(k.read(args, kwalletEntryPassword)), nil
+	case "writePassword":
+		return k.write(args, kwalletEntryPassword, []byte(args[3].(string))), nil
+
+	case "readMap":
+		return k.read(args, kwalletEntryMap), nil
+	case "writeMap":
+		return k.write(args, kwalletEntryMap, args[3].([]byte)), nil
+	}
+
+	return nil, dbus.ErrMsgUnknownMethod
+}
+
+type fakeKWalletHandler struct {
+	k    *fakeKWallet
+	path dbus.ObjectPath
+}
+
+func (h fakeKWalletHandler) LookupObject(path dbus.ObjectPath) (dbus.ServerObject, bool) {
+	return h, path == h.path
+}
+
+func (h fakeKWalletHandler) LookupInterface(name string) (dbus.Interface, bool) {
+	return h, name == "org.kde.KWallet"
+}
+
+func (h fakeKWalletHandler) LookupMethod(name string) (dbus.Method, bool) {
+	return fakeKWalletMethod{h.k, name}, true
+}
+
+// fakeKWalletMethod passes the arguments of calls as they are to
+// fakeKWallet.call.
+type fakeKWalletMethod struct {
+	k    *fakeKWallet
+	name string
+}
+
+func (m fakeKWalletMethod) DecodeArguments(_ *dbus.Conn, _ string, _ *dbus.Message, args []interface{}) ([]interface{}, error) {
+	return args, nil
+}
+
+func (m fakeKWalletMethod) Call(args ...interface{}) ([]interface{}, error) {
+	ret, err := m.k.call(m.name, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return []interface{}{ret}, nil
+}
+
+func (m fakeKWalletMethod) NumArguments() int               { return 0 }
+func (m fakeKWalletMethod) NumReturns() int                 { return 1 }
+func (m fakeKWalletMethod) ArgumentValue(_ int) interface{} { return nil }
+func (m fakeKWalletMethod) ReturnValue(_ int) interface{}   { return nil }
@@ -4,6 +4,7 @@
 package keyring
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
 )
 
 func init() {
@@ -18,13 +21,35 @@ func init() {
 		var err error
 
 		pass := &passKeyring{
-			passcmd: cfg.PassCmd,
-			dir:     cfg.PassDir,
-			prefix:  cfg.PassPrefix,
+			passcmd:      cfg.PassCmd,
+			dir:          cfg.PassDir,
+			prefix:       cfg.PassPrefix,
+			format:       cfg.PassFormat,
+			native:       cfg.PassNative,
+			keyringFiles: cfg.PassKeyringFiles,
+			passwordFunc: cfg.PassPasswordFunc,
+			env:          cfg.PassEnv,
+			profile:      cfg.PassProfile,
+		}
+
+		switch pass.format {
+		case "":
+			pass.format = PassFormatJSON
+		case PassFormatJSON, PassFormatPlain:
+		default:
+			return nil, fmt.Errorf("unknown pass format %q", pass.format)
+		}
+
+		switch pass.profile {
+		case "":
+			pass.profile = PassProfilePass
+		case PassProfilePass, PassProfileGopass:
+		default:
+			return nil, fmt.Errorf("unknown pass profile %q", pass.profile)
 		}
 
 		if pass.passcmd == "" {
-			pass.passcmd = "pass"
+			pass.passcmd = pass.profile
 		}
 
 		if pass.dir == "" {
@@ -36,6 +61,9 @@ func init() {
 					return nil, err
 				}
 				pass.dir = filepath.Join(homeDir, ".password-store")
+				if pass.profile == PassProfileGopass {
+					pass.dir = filepath.Join(homeDir, ".local", "share", "gopass", "stores", "root")
+				}
 			}
 		}
 
@@ -44,6 +72,18 @@ func init() {
 			return nil, err
 		}
 
+		if cfg.PassGnupgHome != "" {
+			gnupgHome, err := ExpandTilde(cfg.PassGnupgHome)
+			if err != nil {
+				return nil, err
+			}
+			pass.env = append(pass.env, fmt.Sprintf("GNUPGHOME=%s", gnupgHome))
+		}
+
+		if pass.native {
+			return pass, nil
+		}
+
 		// fail if the pass program is not available
 		_, err = exec.LookPath(pass.passcmd)
 		if err != nil {
@@ -54,55 +94,298 @@ func init() {
 	})
 }
 
+// passCommands are the arguments for the subcommands of a pass compatible
+// program.
+type passCommands struct {
+	show   []string
+	insert []string
+	rm     []string
+	// init initialises a subfolder of the store, nil if unsupported
+	init []string
+	// showRevision shows the entry at a git revision given next, nil if
+	// unsupported
+	showRevision []string
+}
+
+var passProfileCommands = map[string]passCommands{
+	PassProfilePass: {
+		show:   []string{"show"},
+		insert: []string{"insert", "-m", "-f"},
+		rm:     []string{"rm", "-f"},
+		init:   []string{"init", "--path"},
+	},
+	PassProfileGopass: {
+		show:   []string{"show", "--unsafe", "--noparsing"},
+		insert: []string{"insert", "--multiline", "--force"},
+		rm:     []string{"rm", "--force"},
+
+		showRevision: []string{"show", "--unsafe", "--noparsing", "--revision"},
+	},
+}
+
+// Field names used by PassFormatPlain.
+const (
+	passFieldLabel               = "label"
+	passFieldDescription         = "description"
+	passFieldNotTrustApplication = "keychain-not-trust-application"
+	passFieldNotSynchronizable   = "keychain-not-synchronizable"
+)
+
 type passKeyring struct {
 	dir     string
 	passcmd string
 	prefix  string
+	format  string
+	profile string
+	env     []string
+
+	// passwordFunc is used for the passphrase of secret keys, in native mode
+	// directly and otherwise through gpg's loopback pinentry
+	passwordFunc PromptFunc
+	passphrase   string
+
+	// native mode
+	native       bool
+	keyringFiles []string
+	entities     openpgp.EntityList
 }
 
-func (k *passKeyring) pass(args ...string) *exec.Cmd {
-	cmd := exec.Command(k.passcmd, args...)
+// gpgLoopbackOpts make gpg read the passphrase from file descriptor 3 rather
+// than asking gpg-agent's pinentry.
+var gpgLoopbackOpts = []string{"--pinentry-mode=loopback", "--passphrase-fd=3"}
+
+func (k *passKeyring) commands() passCommands {
+	if c, ok := passProfileCommands[k.profile]; ok {
+		return c
+	}
+	return passProfileCommands[PassProfilePass]
+}
+
+// environ returns the environment for the pass, gpg and git commands.
+func (k *passKeyring) environ() []string {
+	env := append(os.Environ(), k.env...)
 	if k.dir != "" {
-		cmd.Env = append(os.Environ(), fmt.Sprintf("PASSWORD_STORE_DIR=%s", k.dir))
+		env = append(env, fmt.Sprintf("PASSWORD_STORE_DIR=%s", k.dir))
 	}
-	cmd.Stderr = os.Stderr
+
+	return env
+}
+
+func (k *passKeyring) pass(args ...string) *exec.Cmd {
+	cmd := exec.Command(k.passcmd, args...)
+	cmd.Env = k.environ()
 
 	return cmd
 }
 
+// getenv returns the value of an environment variable as seen by the commands.
+func (k *passKeyring) getenv(key string) string {
+	value := os.Getenv(key)
+	for _, kv := range k.env {
+		if strings.HasPrefix(kv, key+"=") {
+			value = strings.TrimPrefix(kv, key+"=")
+		}
+	}
+
+	return value
+}
+
+// runGPG runs a pass or gpg command and returns its output. Error output is
+// captured into the returned error instead of being written to stderr.
+func runGPG(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, gpgError(err, stderr.String())
+	}
+
+	return out, nil
+}
+
+// gpgError classifies the common gpg failures found in its error output.
+func gpgError(err error, stderr string) error {
+	msg := strings.TrimSpace(stderr)
+	switch {
+	case strings.Contains(msg, "No secret key"):
+		err = ErrNoSecretKey
+	case strings.Contains(msg, "Bad passphrase"):
+		err = ErrBadPassphrase
+	case strings.Contains(msg, "Operation cancelled"):
+		err = ErrPromptCancelled
+	}
+
+	if msg == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, msg)
+}
+
+// runDecrypt runs a command which decrypts with gpg. When a passwordFunc is
+// set the passphrase is passed to gpg using loopback pinentry.
+func (k *passKeyring) runDecrypt(cmd *exec.Cmd) ([]byte, error) {
+	if k.passwordFunc == nil {
+		return runGPG(cmd)
+	}
+
+	if k.passphrase == "" {
+		passphrase, err := k.passwordFunc("Enter passphrase to unlock the OpenPGP secret key")
+		if err != nil {
+			return nil, err
+		}
+		k.passphrase = passphrase
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	_, err = w.WriteString(k.passphrase + "\n")
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = []*os.File{r}
+
+	out, err := runGPG(cmd)
+	if errors.Is(err, ErrBadPassphrase) {
+		k.passphrase = ""
+	}
+
+	return out, err
+}
+
+// show returns the decrypted contents of the named entry.
+func (k *passKeyring) show(name string) ([]byte, error) {
+	if k.native {
+		return k.nativeShow(name)
+	}
+
+	cmd := k.pass(append(k.commands().show, name)...)
+
+	// gopass runs gpg itself, ignoring PASSWORD_STORE_GPG_OPTS
+	if k.passwordFunc == nil || k.profile == PassProfileGopass {
+		return runGPG(cmd)
+	}
+
+	opts := append(strings.Fields(k.getenv("PASSWORD_STORE_GPG_OPTS")), gpgLoopbackOpts...)
+	cmd.Env = append(cmd.Env, "PASSWORD_STORE_GPG_OPTS="+strings.Join(opts, " "))
+
+	return k.runDecrypt(cmd)
+}
+
+// decrypt returns the decrypted contents of an encrypted entry. Like pass,
+// gpg2 is preferred over gpg and PASSWORD_STORE_GPG_OPTS is honoured.
+func (k *passKeyring) decrypt(ciphertext []byte) ([]byte, error) {
+	if k.native {
+		return k.nativeDecrypt(bytes.NewReader(ciphertext))
+	}
+
+	gpg := "gpg"
+	if _, err := exec.LookPath("gpg2"); err == nil {
+		gpg = "gpg2"
+	}
+
+	args := append(strings.Fields(k.getenv("PASSWORD_STORE_GPG_OPTS")), "--quiet", "--decrypt")
+	if k.passwordFunc != nil {
+		args = append(args, gpgLoopbackOpts...)
+	}
+	cmd := exec.Command(gpg, args...)
+	cmd.Env = k.environ()
+	cmd.Stdin = bytes.NewReader(ciphertext)
+
+	return k.runDecrypt(cmd)
+}
+
+// insert encrypts data into the named entry, replacing any existing one.
+// The pass program commits to git itself, native mode does so here.
+func (k *passKeyring) insert(name string, data []byte) error {
+	if !k.native {
+		cmd := k.pass(append(k.commands().insert, name)...)
+		cmd.Stdin = bytes.NewReader(data)
+
+		_, err := runGPG(cmd)
+		return err
+	}
+
+	message := fmt.Sprintf("Add %s to store.", name)
+	if k.entryExists(name) {
+		message = fmt.Sprintf("Update %s in store.", name)
+	}
+
+	if err := k.nativeInsert(name, data); err != nil {
+		return err
+	}
+
+	return k.gitCommit(name+".gpg", message)
+}
+
+// rm removes the named entry.
+func (k *passKeyring) rm(name string) error {
+	if !k.native {
+		_, err := runGPG(k.pass(append(k.commands().rm, name)...))
+		return err
+	}
+
+	if err := k.nativeRemove(name); err != nil {
+		return err
+	}
+
+	return k.gitCommit(name+".gpg", fmt.Sprintf("Remove %s from store.", name))
+}
+
 func (k *passKeyring) Get(key string) (Item, error) {
 	if !k.itemExists(key) {
 		return Item{}, ErrKeyNotFound
 	}
 
 	name := filepath.Join(k.prefix, key)
-	cmd := k.pass("show", name)
-	output, err := cmd.Output()
+	output, err := k.show(name)
 	if err != nil {
 		return Item{}, err
 	}
 
-	var decoded Item
-	err = json.Unmarshal(output, &decoded)
-
-	return decoded, err
+	return decodePassItem(key, output)
 }
 
+// GetMetadata for pass only returns the modification time, taken from the
+// git history when the store is a git repository, as the rest is encrypted.
 func (k *passKeyring) GetMetadata(key string) (Metadata, error) {
-	return Metadata{}, nil
+	name := filepath.Join(k.prefix, key)
+	stat, err := os.Stat(filepath.Join(k.dir, name+".gpg"))
+	if os.IsNotExist(err) {
+		return Metadata{}, ErrKeyNotFound
+	} else if err != nil {
+		return Metadata{}, err
+	}
+
+	md := Metadata{
+		ModificationTime: stat.ModTime(),
+	}
+
+	if k.isGit() {
+		revisions, err := k.gitLog(name, 1)
+		if err != nil {
+			debugf("Unable to read the git history of %s: %v", name, err)
+		} else if len(revisions) > 0 {
+			md.ModificationTime = revisions[0].Time
+		}
+	}
+
+	return md, nil
 }
 
 func (k *passKeyring) Set(i Item) error {
-	bytes, err := json.Marshal(i)
+	bytes, err := encodePassItem(k.format, i)
 	if err != nil {
 		return err
 	}
 
 	name := filepath.Join(k.prefix, i.Key)
-	cmd := k.pass("insert", "-m", "-f", name)
-	cmd.Stdin = strings.NewReader(string(bytes))
-
-	err = cmd.Run()
+	err = k.insert(name, bytes)
 	if err != nil {
 		return err
 	}
@@ -116,8 +399,7 @@ func (k *passKeyring) Remove(key string) error {
 	}
 
 	name := filepath.Join(k.prefix, key)
-	cmd := k.pass("rm", "-f", name)
-	err := cmd.Run()
+	err := k.rm(name)
 	if err != nil {
 		return err
 	}
@@ -126,7 +408,11 @@ func (k *passKeyring) Remove(key string) error {
 }
 
 func (k *passKeyring) itemExists(key string) bool {
-	var path = filepath.Join(k.dir, k.prefix, key+".gpg")
+	return k.entryExists(filepath.Join(k.prefix, key))
+}
+
+func (k *passKeyring) entryExists(name string) bool {
+	var path = filepath.Join(k.dir, name+".gpg")
 	_, err := os.Stat(path)
 
 	return err == nil
@@ -147,20 +433,117 @@ func (k *passKeyring) Keys() ([]string, error) {
 		return keys, fmt.Errorf("%s is not a directory", path)
 	}
 
-	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+	err = walkPassEntries(path, func(p string) error {
+		name := strings.TrimPrefix(p, path)
+		if name[0] == os.PathSeparator {
+			name = name[1:]
+		}
+		keys = append(keys, name[:len(name)-4])
+		return nil
+	})
+
+	return keys, err
+}
+
+// walkPassEntries calls fn with the filename of every entry below start,
+// skipping git's files and those of pass extensions like pass does.
+func walkPassEntries(start string, fn func(filename string) error) error {
+	return filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
+			if os.IsNotExist(err) && p == start {
+				return nil
+			}
 			return err
 		}
 
+		if info.IsDir() && p != start && (info.Name() == ".git" || info.Name() == ".extensions") {
+			return filepath.SkipDir
+		}
+
 		if !info.IsDir() && filepath.Ext(p) == ".gpg" {
-			name := strings.TrimPrefix(p, path)
-			if name[0] == os.PathSeparator {
-				name = name[1:]
-			}
-			keys = append(keys, name[:len(name)-4])
+			return fn(p)
 		}
 		return nil
 	})
+}
 
-	return keys, err
+// Close forgets the passphrase and, in native mode, the decrypted secret keys.
+func (k *passKeyring) Close() error {
+	k.passphrase = ""
+	k.entities = nil
+	return nil
+}
+
+func encodePassItem(format string, i Item) ([]byte, error) {
+	if format != PassFormatPlain {
+		return json.Marshal(i)
+	}
+
+	// each field is a line of its own
+	for _, field := range [][2]string{
+		{"data", string(i.Data)},
+		{passFieldLabel, i.Label},
+		{passFieldDescription, i.Description},
+	} {
+		if strings.ContainsAny(field[1], "\r\n") {
+			return nil, fmt.Errorf("The plain pass format can't store a %s containing newlines", field[0])
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(i.Data)
+	b.WriteString("\n")
+	if i.Label != "" {
+		fmt.Fprintf(&b, "%s: %s\n", passFieldLabel, i.Label)
+	}
+	if i.Description != "" {
+		fmt.Fprintf(&b, "%s: %s\n", passFieldDescription, i.Description)
+	}
+	if i.KeychainNotTrustApplication {
+		fmt.Fprintf(&b, "%s: true\n", passFieldNotTrustApplication)
+	}
+	if i.KeychainNotSynchronizable {
+		fmt.Fprintf(&b, "%s: true\n", passFieldNotSynchronizable)
+	}
+
+	return b.Bytes(), nil
+}
+
+// decodePassItem reads an entry in either format. Entries which aren't JSON
+// items, such as those created with pass insert, are read as plain, even when
+// the password happens to be a JSON object.
+func decodePassItem(key string, data []byte) (Item, error) {
+	if bytes.HasPrefix(data, []byte("{")) {
+		var decoded Item
+		if err := json.Unmarshal(data, &decoded); err == nil && decoded.Key != "" {
+			return decoded, nil
+		}
+	}
+
+	lines := strings.Split(string(data), "\n")
+	item := Item{
+		Key:  key,
+		Data: []byte(strings.TrimSuffix(lines[0], "\r")),
+	}
+
+	for _, line := range lines[1:] {
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case passFieldLabel:
+			item.Label = value
+		case passFieldDescription:
+			item.Description = value
+		case passFieldNotTrustApplication:
+			item.KeychainNotTrustApplication = value == "true"
+		case passFieldNotSynchronizable:
+			item.KeychainNotSynchronizable = value == "true"
+		}
+	}
+
+	return item, nil
 }
@@ -5,12 +5,16 @@ package keyring
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
 )
 
 func runCmd(t *testing.T, cmds ...string) {
@@ -248,3 +252,678 @@ func TestPassKeyringKeysWithSymlink(t *testing.T) {
 		t.Fatalf("Expected keys %v, got %v", expectedKeys, keys)
 	}
 }
+
+func setupNative(t *testing.T) *passKeyring {
+	t.Helper()
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := &passKeyring{
+		dir:          t.TempDir(),
+		prefix:       "keyring",
+		native:       true,
+		keyringFiles: []string{filepath.Join(pwd, "testdata", "test-gpg.key")},
+	}
+
+	err = os.WriteFile(filepath.Join(k.dir, ".gpg-id"), []byte("test@example.com\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k
+}
+
+func TestPassKeyringNativeSetAndGet(t *testing.T) {
+	k := setupNative(t)
+
+	items := []Item{
+		{Key: "llamas", Data: []byte("llamas are great")},
+		{Key: "africa/elephants", Data: []byte("who doesn't like elephants")},
+	}
+	for _, item := range items {
+		if err := k.Set(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, item := range items {
+		foundItem, err := k.Get(item.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(foundItem.Data, item.Data) {
+			t.Fatalf("Value stored was not the value retrieved: %q", foundItem.Data)
+		}
+	}
+
+	if err := k.Remove("africa/elephants"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(k.dir, "keyring", "africa")); !os.IsNotExist(err) {
+		t.Fatal("Expected empty directory to be removed")
+	}
+}
+
+func TestPassKeyringNativeCompatibleWithGPG(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+
+	k := setupNative(t)
+
+	gnupghome := filepath.Join(t.TempDir(), ".gnupg")
+	if err := os.Mkdir(gnupghome, 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GNUPGHOME", gnupghome)
+	runCmd(t, "gpg", "--batch", "--import", k.keyringFiles[0])
+
+	// written natively, read by gpg
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("gpg", "--batch", "--quiet", "--decrypt", filepath.Join(k.dir, "keyring", "llamas.gpg")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte(`"Key":"llamas"`)) {
+		t.Fatalf("Unexpected output from gpg: %q", out)
+	}
+
+	// decrypted by gpg using loopback pinentry
+	k.native = false
+	k.passwordFunc = FixedStringPrompt("")
+	ciphertext, err := os.ReadFile(filepath.Join(k.dir, "keyring", "llamas.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = k.decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte(`"Key":"llamas"`)) {
+		t.Fatalf("Unexpected output from gpg: %q", out)
+	}
+	k.native = true
+
+	// written by gpg, read natively
+	runCmd(t, "gpg", "--batch", "--yes", "--trust-model", "always", "--compress-algo=none", "-e", "-r", "test@example.com",
+		"-o", filepath.Join(k.dir, "keyring", "alpacas.gpg"), filepath.Join(k.dir, "keyring", "..", ".gpg-id"))
+	out, err = k.show(filepath.Join("keyring", "alpacas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "test@example.com\n" {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+}
+
+func TestPassKeyringPlainFormat(t *testing.T) {
+	k := setupNative(t)
+	k.format = PassFormatPlain
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great"), Label: "Llamas", Description: "A llama fact"}
+	if err := k.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := k.show(filepath.Join("keyring", "llamas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "llamas are great\nlabel: Llamas\ndescription: A llama fact\n"
+	if string(out) != expected {
+		t.Fatalf("Expected %q, got %q", expected, out)
+	}
+
+	foundItem, err := k.Get("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(foundItem, item) {
+		t.Fatalf("Expected %+v, got %+v", item, foundItem)
+	}
+
+	if err := k.Set(Item{Key: "multiline", Data: []byte("one\ntwo")}); err == nil {
+		t.Fatal("Expected an error storing multiline data in the plain format")
+	}
+	if err := k.Set(Item{Key: "multiline", Data: []byte("one"), Label: "one\nurl: https://example.com"}); err == nil {
+		t.Fatal("Expected an error storing a multiline label in the plain format")
+	}
+	if err := k.Set(Item{Key: "multiline", Data: []byte("one"), Description: "one\r\ntwo"}); err == nil {
+		t.Fatal("Expected an error storing a multiline description in the plain format")
+	}
+}
+
+func TestDecodePassItem(t *testing.T) {
+	legacy, err := decodePassItem("llamas", []byte(`{"Key":"llamas","Data":"bGxhbWFzIGFyZSBncmVhdA==","Label":"Llamas"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(legacy.Data) != "llamas are great" || legacy.Label != "Llamas" {
+		t.Fatalf("Unexpected item decoded from JSON: %+v", legacy)
+	}
+
+	// as created by pass insert
+	plain, err := decodePassItem("alpacas", []byte("hunter2\nlogin: alpaca\nurl: https://example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Key != "alpacas" || string(plain.Data) != "hunter2" {
+		t.Fatalf("Unexpected item decoded from plain text: %+v", plain)
+	}
+
+	// a password that is a JSON object, but not an item
+	for _, password := range []string{`{}`, `{"Data":"bGxhbWFzIGFyZSBncmVhdA=="}`} {
+		plain, err = decodePassItem("alpacas", []byte(password+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plain.Key != "alpacas" || string(plain.Data) != password {
+			t.Fatalf("Unexpected item decoded from plain text: %+v", plain)
+		}
+	}
+}
+
+func TestPassKeyringNativeGitHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	k := setupNative(t)
+	t.Setenv("GIT_AUTHOR_NAME", "keyring")
+	t.Setenv("GIT_AUTHOR_EMAIL", "keyring@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "keyring")
+	t.Setenv("GIT_COMMITTER_EMAIL", "keyring@example.com")
+	runCmd(t, "git", "-C", k.dir, "init", "--quiet")
+
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are okay")}); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := k.History("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Expected 2 revisions, got %d", len(revisions))
+	}
+	if revisions[0].Message != "Update keyring/llamas in store." {
+		t.Fatalf("Unexpected commit message %q", revisions[0].Message)
+	}
+
+	previous, err := k.GetRevision("llamas", revisions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(previous.Data) != "llamas are great" {
+		t.Fatalf("Unexpected previous value %q", previous.Data)
+	}
+	for _, revision := range []string{"", "--output=" + filepath.Join(k.dir, "pwned"), "no-such-revision"} {
+		if _, err := k.GetRevision("llamas", revision); err == nil {
+			t.Fatalf("Expected an error for revision %q", revision)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(k.dir, "pwned")); !os.IsNotExist(err) {
+		t.Fatal("Expected the revision not to be passed to git as an option")
+	}
+
+	md, err := k.GetMetadata("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.ModificationTime.Equal(revisions[0].Time) {
+		t.Fatalf("Expected modification time %v, got %v", revisions[0].Time, md.ModificationTime)
+	}
+
+	// without the git history the file's is used
+	env := k.env
+	k.env = append(k.env, "GIT_DIR="+filepath.Join(k.dir, "no-such-dir"))
+	md, err = k.GetMetadata("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filepath.Join(k.dir, "keyring", "llamas.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.ModificationTime.Equal(stat.ModTime()) {
+		t.Fatalf("Expected modification time %v, got %v", stat.ModTime(), md.ModificationTime)
+	}
+	k.env = env
+
+	if err := k.Remove("llamas"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("git", "-C", k.dir, "status", "--porcelain").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("llamas")) {
+		t.Fatalf("Expected the removal to be committed, got %q", out)
+	}
+}
+
+func TestPassKeyringGopassRevision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	tmpdir := t.TempDir()
+	logfile := filepath.Join(tmpdir, "log")
+
+	// A stand-in for gopass that records how it was called
+	script := filepath.Join(t.TempDir(), "fakegopass")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+echo "$@" >> "$FAKEPASS_LOG"
+echo '{"Key":"llamas","Data":"bGxhbWFzIGFyZSBncmVhdA=="}'
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd(t, "git", "-C", tmpdir, "init", "--quiet")
+	runCmd(t, "git", "-C", tmpdir, "-c", "user.name=keyring", "-c", "user.email=keyring@example.com",
+		"commit", "--quiet", "--allow-empty", "-m", "Add llamas to store.")
+	commit, err := exec.Command("git", "-C", tmpdir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := &passKeyring{
+		dir:     tmpdir,
+		passcmd: script,
+		profile: PassProfileGopass,
+		format:  PassFormatJSON,
+		env:     []string{"FAKEPASS_LOG=" + logfile},
+	}
+
+	// gopass decrypts past revisions itself
+	item, err := k.GetRevision("llamas", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(item.Data) != "llamas are great" {
+		t.Fatalf("Unexpected value %q", item.Data)
+	}
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "show --unsafe --noparsing --revision " + strings.TrimSpace(string(commit)) + " llamas\n"
+	if string(log) != expected {
+		t.Fatalf("Expected calls %q, got %q", expected, log)
+	}
+}
+
+// newSecondRecipient writes a keyring with the secret key of
+// second@example.com, returning its filename.
+func newSecondRecipient(t *testing.T) string {
+	t.Helper()
+
+	second, err := openpgp.NewEntity("Second", "", "second@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondKeyring := filepath.Join(t.TempDir(), "second.gpg")
+	var buf bytes.Buffer
+	if err := second.SerializePrivate(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secondKeyring, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return secondKeyring
+}
+
+func TestPassKeyringNativeRecipients(t *testing.T) {
+	k := setupNative(t)
+
+	secondKeyring := newSecondRecipient(t)
+	k.keyringFiles = append(k.keyringFiles, secondKeyring)
+
+	if err := k.Set(Item{Key: "team/llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.AddRecipients("team", "second@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := k.Recipients("team/llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(recipients, []string{"test@example.com", "second@example.com"}) {
+		t.Fatalf("Unexpected recipients %v", recipients)
+	}
+	if _, err := os.Stat(filepath.Join(k.dir, "keyring", "team", ".gpg-id")); err != nil {
+		t.Fatal(err)
+	}
+
+	onlySecond := &passKeyring{dir: k.dir, prefix: k.prefix, native: true, keyringFiles: []string{secondKeyring}}
+	if _, err := onlySecond.Get("team/llamas"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.RemoveRecipients("team", "second@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := onlySecond.Get("team/llamas"); err == nil {
+		t.Fatal("Expected the removed recipient to be unable to decrypt")
+	}
+}
+
+func TestPassKeyringGPGErrors(t *testing.T) {
+	exitErr := errors.New("exit status 2")
+
+	cases := map[string]error{
+		"gpg: decryption failed: No secret key":                   ErrNoSecretKey,
+		"gpg: public key decryption failed: Bad passphrase":       ErrBadPassphrase,
+		"gpg: public key decryption failed: Operation cancelled":  ErrPromptCancelled,
+		"gpg: can't open 'llamas.gpg': No such file or directory": exitErr,
+	}
+	for stderr, expected := range cases {
+		err := gpgError(exitErr, stderr+"\n")
+		if !errors.Is(err, expected) {
+			t.Fatalf("Expected %v for %q, got %v", expected, stderr, err)
+		}
+		if !strings.Contains(err.Error(), stderr) {
+			t.Fatalf("Expected the error output in %q", err)
+		}
+	}
+}
+
+func TestPassKeyringNativeNoSecretKey(t *testing.T) {
+	k := setupNative(t)
+	if err := k.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.entities = openpgp.EntityList{other}
+
+	if _, err := k.Get("llamas"); !errors.Is(err, ErrNoSecretKey) {
+		t.Fatalf("Expected ErrNoSecretKey, got %v", err)
+	}
+}
+
+func TestPassKeyringNativeNoPrompt(t *testing.T) {
+	k := setupNative(t)
+
+	e, err := openpgp.NewEntity("Locked", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.PrivateKey.Encrypt([]byte("sesame")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range e.Subkeys {
+		if err = sub.PrivateKey.Encrypt([]byte("sesame")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k.entities = openpgp.EntityList{e}
+
+	if err = k.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = k.Get("llamas")
+	if !errors.Is(err, ErrNoSecretKey) || !strings.Contains(err.Error(), "PassPasswordFunc") {
+		t.Fatalf("Expected ErrNoSecretKey for the missing prompt, got %v", err)
+	}
+
+	k.passwordFunc = FixedStringPrompt("sesame")
+	if _, err = k.Get("llamas"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindEntity(t *testing.T) {
+	newEntity := func(name, email string) *openpgp.Entity {
+		t.Helper()
+		e, err := openpgp.NewEntity(name, "", email, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	test := newEntity("Test", "test@example.com")
+	other := newEntity("Other", "atest@example.com")
+	entities := openpgp.EntityList{other, test}
+
+	fingerprint := fmt.Sprintf("%X", test.PrimaryKey.Fingerprint)
+	for _, recipient := range []string{
+		"test@example.com",
+		"<TEST@example.com>",
+		fingerprint,
+		"0x" + strings.ToLower(fingerprint) + "!",
+		test.PrimaryKey.KeyIdString(),
+		test.PrimaryKey.KeyIdShortString(),
+		test.Subkeys[0].PublicKey.KeyIdString(),
+	} {
+		if e, err := findEntity(entities, recipient); err != nil || e != test {
+			t.Fatalf("Expected %q to find the test key, got %v", recipient, err)
+		}
+	}
+
+	// only whole emails and IDs match
+	for _, recipient := range []string{"Test", "example.com", fingerprint[len(fingerprint)-12:], "unknown@example.com"} {
+		if e, err := findEntity(entities, recipient); err == nil {
+			t.Fatalf("Expected %q not to be found, got %v", recipient, e.PrimaryKey.KeyIdString())
+		}
+	}
+
+	entities = append(entities, newEntity("Test again", "test@example.com"))
+	if _, err := findEntity(entities, "test@example.com"); err == nil {
+		t.Fatal("Expected an email of several keys to be refused")
+	}
+}
+
+func TestPassKeyringProfileAndEnv(t *testing.T) {
+	tmpdir := t.TempDir()
+	logfile := filepath.Join(tmpdir, "log")
+
+	// A stand-in for pass that records how it was called
+	script := filepath.Join(tmpdir, "fakepass")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+echo "$@" >> "$FAKEPASS_LOG"
+echo "GNUPGHOME=$GNUPGHOME" >> "$FAKEPASS_LOG"
+cat > /dev/null
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := Open(Config{
+		AllowedBackends: []BackendType{PassBackend},
+		PassCmd:         script,
+		PassDir:         tmpdir,
+		PassProfile:     PassProfileGopass,
+		PassEnv:         []string{"FAKEPASS_LOG=" + logfile},
+		PassGnupgHome:   "/tmp/gnupg-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = k.Set(Item{Key: "llamas", Data: []byte("are great")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(tmpdir, "llamas.gpg"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.Remove("llamas"); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "insert --multiline --force llamas\nGNUPGHOME=/tmp/gnupg-test\nrm --force llamas\nGNUPGHOME=/tmp/gnupg-test\n"
+	if string(log) != expected {
+		t.Fatalf("Expected calls %q, got %q", expected, log)
+	}
+
+	if err = k.(RecipientKeyring).SetRecipients("", []string{"test@example.com"}); err == nil {
+		t.Fatal("Expected setting recipients to be unsupported by gopass")
+	}
+
+	if _, err = Open(Config{AllowedBackends: []BackendType{PassBackend}, PassProfile: "nope"}); err == nil {
+		t.Fatal("Expected an error for an unknown profile")
+	}
+}
+
+func TestPassKeyringNativeReencryptDotDirectories(t *testing.T) {
+	k := setupNative(t)
+
+	secondKeyring := newSecondRecipient(t)
+	k.keyringFiles = append(k.keyringFiles, secondKeyring)
+
+	if err := k.Set(Item{Key: ".ssh/id", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// files of pass extensions aren't entries, even when they look like them
+	extensions := filepath.Join(k.dir, k.prefix, ".extensions")
+	if err := os.MkdirAll(extensions, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(extensions, "stray.gpg"), []byte("not an entry"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.AddRecipients("", "second@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	onlySecond := &passKeyring{dir: k.dir, prefix: k.prefix, native: true, keyringFiles: []string{secondKeyring}}
+	if _, err := onlySecond.Get(".ssh/id"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys skips them alike
+	keys, err := k.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != filepath.Join(".ssh", "id") {
+		t.Fatalf("Expected only .ssh/id, got %v", keys)
+	}
+}
+
+func TestPassKeyringNativeReencryptCommitsOnce(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	k := setupNative(t)
+	k.keyringFiles = append(k.keyringFiles, newSecondRecipient(t))
+	t.Setenv("GIT_AUTHOR_NAME", "keyring")
+	t.Setenv("GIT_AUTHOR_EMAIL", "keyring@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "keyring")
+	t.Setenv("GIT_COMMITTER_EMAIL", "keyring@example.com")
+	runCmd(t, "git", "-C", k.dir, "init", "--quiet")
+
+	for _, key := range []string{"llamas", "alpacas", "team/vicunas"} {
+		if err := k.Set(Item{Key: key, Data: []byte(key + " are great")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commits := func() string {
+		t.Helper()
+		out, err := exec.Command("git", "-C", k.dir, "log", "--format=%s").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	before := commits()
+
+	if err := k.AddRecipients("", "second@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Reencrypt password store (keyring).\nSet GPG id to test@example.com, second@example.com.\n" + before
+	if log := commits(); log != expected {
+		t.Fatalf("Expected commits %q, got %q", expected, log)
+	}
+}
+
+func TestPassKeyringReencryptWithPassInit(t *testing.T) {
+	tmpdir := t.TempDir()
+	logfile := filepath.Join(tmpdir, "log")
+
+	// A stand-in for pass that records how it was called
+	script := filepath.Join(t.TempDir(), "fakepass")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+echo "$@" >> "$FAKEPASS_LOG"
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.MkdirAll(filepath.Join(tmpdir, "team", "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(tmpdir, "team", ".gpg-id"), []byte("test@example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	k := &passKeyring{
+		dir:     tmpdir,
+		passcmd: script,
+		profile: PassProfilePass,
+		env:     []string{"FAKEPASS_LOG=" + logfile},
+	}
+
+	// pass init re-encrypts below the .gpg-id the entries get their
+	// recipients from
+	if err = k.Reencrypt("team/sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := os.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "init --path team test@example.com\n"; string(log) != expected {
+		t.Fatalf("Expected calls %q, got %q", expected, log)
+	}
+
+	k.profile = PassProfileGopass
+	if err = k.Reencrypt("team"); err == nil || !strings.Contains(err.Error(), "native mode") {
+		t.Fatalf("Expected re-encrypting to be unsupported by gopass, got %v", err)
+	}
+}
+
+func TestPassKeyringNativeAddRecipientsWhenUnreadable(t *testing.T) {
+	k := setupNative(t)
+
+	// a .gpg-id that can't be read mustn't be taken for no recipients
+	gpgID := filepath.Join(k.dir, ".gpg-id")
+	if err := os.Remove(gpgID); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(gpgID, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.AddRecipients("team", "second@example.com"); err == nil {
+		t.Fatal("Expected an error reading the recipients")
+	}
+	if _, err := os.Stat(filepath.Join(k.dir, k.prefix, "team", ".gpg-id")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no .gpg-id to be written, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+//go:build !windows
+// +build !windows
+
+package keyring
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isGit reports whether the password-store is a git repository, which is how
+// pass decides whether to commit changes.
+func (k *passKeyring) isGit() bool {
+	stat, err := os.Stat(filepath.Join(k.dir, ".git"))
+	return err == nil && stat.IsDir()
+}
+
+func (k *passKeyring) git(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", k.dir}, args...)...)
+	cmd.Env = k.environ()
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// gitCommit commits the changes to a path relative to the store, if the
+// store is a git repository.
+func (k *passKeyring) gitCommit(path string, message string) error {
+	if !k.isGit() {
+		return nil
+	}
+
+	if _, err := k.git("add", "--all", "--", path); err != nil {
+		return err
+	}
+
+	// like pass, don't commit when nothing changed
+	status, err := k.git("status", "--porcelain", "--", path)
+	if err != nil || len(status) == 0 {
+		return err
+	}
+	_, err = k.git("commit", "--quiet", "--message", message, "--", path)
+
+	return err
+}
+
+// gitLog returns up to limit revisions of the named entry, newest first. A limit
+// of 0 means all revisions.
+func (k *passKeyring) gitLog(name string, limit int) ([]Revision, error) {
+	args := []string{"log", "--format=%H%x00%ct%x00%s"}
+	if limit > 0 {
+		args = append(args, "-n", strconv.Itoa(limit))
+	}
+	args = append(args, "--", name+".gpg")
+
+	out, err := k.git(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []Revision{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\x00", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, Revision{
+			ID:      fields[0],
+			Time:    time.Unix(timestamp, 0),
+			Message: fields[2],
+		})
+	}
+
+	return revisions, nil
+}
+
+// History returns the revisions of an item from the git history of the store.
+func (k *passKeyring) History(key string) ([]Revision, error) {
+	if !k.isGit() {
+		return nil, fmt.Errorf("The password-store %q is not a git repository", k.dir)
+	}
+
+	return k.gitLog(filepath.Join(k.prefix, key), 0)
+}
+
+// GetRevision returns an item as it was at a revision from History.
+func (k *passKeyring) GetRevision(key string, revision string) (Item, error) {
+	if !k.isGit() {
+		return Item{}, fmt.Errorf("The password-store %q is not a git repository", k.dir)
+	}
+
+	// a revision starting with a dash would be taken for an option
+	if revision == "" || strings.HasPrefix(revision, "-") {
+		return Item{}, fmt.Errorf("Invalid revision %q", revision)
+	}
+	commit, err := k.git("rev-parse", "--verify", "--quiet", revision+"^{commit}")
+	if err != nil {
+		return Item{}, fmt.Errorf("Invalid revision %q", revision)
+	}
+
+	output, err := k.showRevision(filepath.Join(k.prefix, key), strings.TrimSpace(string(commit)))
+	if err != nil {
+		return Item{}, err
+	}
+
+	return decodePassItem(key, output)
+}
+
+// showRevision returns the decrypted contents of the named entry at a commit,
+// through the pass program when it can show past revisions itself.
+func (k *passKeyring) showRevision(name string, commit string) ([]byte, error) {
+	if c := k.commands().showRevision; !k.native && c != nil {
+		return runGPG(k.pass(append(c, commit, name)...))
+	}
+
+	ciphertext, err := k.git("show", commit+":"+filepath.ToSlash(name)+".gpg")
+	if err != nil {
+		return nil, err
+	}
+
+	return k.decrypt(ciphertext)
+}
@@ -0,0 +1,219 @@
+//go:build !windows
+// +build !windows
+
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// loadEntities reads the OpenPGP keyrings used by native mode.
+func (k *passKeyring) loadEntities() (openpgp.EntityList, error) {
+	if k.entities != nil {
+		return k.entities, nil
+	}
+
+	if len(k.keyringFiles) == 0 {
+		return nil, errors.New("No OpenPGP keyring files provided for native pass mode")
+	}
+
+	var entities openpgp.EntityList
+	for _, f := range k.keyringFiles {
+		filename, err := ExpandTilde(f)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		var el openpgp.EntityList
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+			el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		} else {
+			el, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading keyring %q failed: %v", filename, err)
+		}
+		entities = append(entities, el...)
+	}
+	k.entities = entities
+
+	return entities, nil
+}
+
+// findEntity finds the key for a recipient as written in a .gpg-id file,
+// either a key ID or fingerprint in hex, or an email address. Other forms gpg
+// accepts, such as parts of a user ID, could match the wrong key, and a
+// recipient matching several keys is refused for the same reason.
+func findEntity(entities openpgp.EntityList, recipient string) (*openpgp.Entity, error) {
+	id := strings.TrimSuffix(strings.ToUpper(recipient), "!")
+	id = strings.TrimPrefix(id, "0X")
+	isHex := strings.Trim(id, "0123456789ABCDEF") == ""
+	email := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(recipient, "<"), ">"))
+
+	matches := func(pk *packet.PublicKey) bool {
+		switch len(id) {
+		case 8:
+			return pk.KeyIdShortString() == id
+		case 16:
+			return pk.KeyIdString() == id
+		case 40, 64:
+			return fmt.Sprintf("%X", pk.Fingerprint) == id
+		}
+		return false
+	}
+
+	var found *openpgp.Entity
+	for _, e := range entities {
+		match := false
+		if isHex {
+			match = matches(e.PrimaryKey)
+			for _, sub := range e.Subkeys {
+				match = match || matches(sub.PublicKey)
+			}
+		} else {
+			for _, ident := range e.Identities {
+				match = match || strings.ToLower(ident.UserId.Email) == email
+			}
+		}
+		if !match {
+			continue
+		}
+
+		if found != nil && found.PrimaryKey.KeyId != e.PrimaryKey.KeyId {
+			return nil, fmt.Errorf("Recipient %q matches several keys", recipient)
+		}
+		found = e
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("No public key found for recipient %q", recipient)
+	}
+
+	return found, nil
+}
+
+func (k *passKeyring) nativeShow(name string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(k.dir, name+".gpg"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return k.nativeDecrypt(f)
+}
+
+func (k *passKeyring) nativeDecrypt(r io.Reader) ([]byte, error) {
+	entities, err := k.loadEntities()
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := openpgp.ReadMessage(r, entities, k.promptSecretKey, nil)
+	if err == pgperrors.ErrKeyIncorrect {
+		return nil, ErrNoSecretKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(md.UnverifiedBody)
+}
+
+// promptSecretKey unlocks the passphrase protected secret keys that can
+// decrypt a message.
+func (k *passKeyring) promptSecretKey(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	if symmetric {
+		return nil, errors.New("Symmetrically encrypted entries are not supported")
+	}
+	if k.passwordFunc == nil {
+		return nil, fmt.Errorf("%w: the secret key is protected by a passphrase and no PassPasswordFunc is configured to prompt for it", ErrNoSecretKey)
+	}
+
+	for _, key := range keys {
+		if key.PrivateKey == nil || !key.PrivateKey.Encrypted {
+			continue
+		}
+
+		passphrase, err := k.passwordFunc(fmt.Sprintf("Enter passphrase to unlock OpenPGP key %X", key.PublicKey.KeyId))
+		if err != nil {
+			return nil, err
+		}
+		if err := key.PrivateKey.Decrypt([]byte(passphrase)); err == nil {
+			return nil, nil
+		}
+	}
+
+	return nil, ErrBadPassphrase
+}
+
+func (k *passKeyring) nativeInsert(name string, data []byte) error {
+	entities, err := k.loadEntities()
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(k.dir, name+".gpg")
+	ids, err := passRecipients(k.dir, filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+
+	recipients := []*openpgp.Entity{}
+	for _, id := range ids {
+		e, err := findEntity(entities, id)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, e)
+	}
+
+	// Match pass, which disables compression
+	config := &packet.Config{DefaultCompressionAlgo: packet.CompressionNone}
+
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, recipients, nil, nil, config)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0600)
+}
+
+func (k *passKeyring) nativeRemove(name string) error {
+	filename := filepath.Join(k.dir, name+".gpg")
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+
+	// Like pass, clean up directories left empty
+	for dir := filepath.Dir(filename); dir != k.dir && strings.HasPrefix(dir, k.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
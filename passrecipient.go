@@ -0,0 +1,202 @@
+//go:build !windows
+// +build !windows
+
+package keyring
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// passGpgIDName is the file listing the recipients of the entries in a
+// password-store directory and the directories below it.
+const passGpgIDName = ".gpg-id"
+
+var errNoPassRecipients = fmt.Errorf("No %s found", passGpgIDName)
+
+// passRecipients returns the recipients from the nearest .gpg-id file in dir
+// or any of its parents up to the root of the store, like pass does.
+func passRecipients(root, dir string) ([]string, error) {
+	recipients, _, err := passGpgID(root, dir)
+	return recipients, err
+}
+
+// passGpgID returns the recipients from the nearest .gpg-id file, see
+// passRecipients, and the directory it's in.
+func passGpgID(root, dir string) ([]string, string, error) {
+	for {
+		f, err := os.Open(filepath.Join(dir, passGpgIDName))
+		if err == nil {
+			defer f.Close()
+
+			recipients := []string{}
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if i := strings.Index(line, "#"); i >= 0 {
+					line = strings.TrimSpace(line[:i])
+				}
+				if line != "" {
+					recipients = append(recipients, line)
+				}
+			}
+			return recipients, dir, scanner.Err()
+		} else if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+
+		if dir == root || !strings.HasPrefix(dir, root) {
+			return nil, "", fmt.Errorf("%w for %q, the password-store needs to be initialised", errNoPassRecipients, dir)
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Recipients returns the recipients the item with the given key is encrypted
+// to, from the nearest .gpg-id file.
+func (k *passKeyring) Recipients(key string) ([]string, error) {
+	filename := filepath.Join(k.dir, k.prefix, key+".gpg")
+
+	return passRecipients(k.dir, filepath.Dir(filename))
+}
+
+// SetRecipients initialises a directory under the prefix, or the whole store
+// for "", with recipients and re-encrypts the entries below it.
+func (k *passKeyring) SetRecipients(dir string, recipients []string) error {
+	if len(recipients) == 0 {
+		return errors.New("At least one recipient is required")
+	}
+
+	path := filepath.Join(k.prefix, dir)
+	if !k.native {
+		return k.init(path, recipients)
+	}
+
+	if err := os.MkdirAll(filepath.Join(k.dir, path), 0700); err != nil {
+		return err
+	}
+
+	gpgID := filepath.Join(path, passGpgIDName)
+	contents := strings.Join(recipients, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(k.dir, gpgID), []byte(contents), 0600); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Set GPG id to %s.", strings.Join(recipients, ", "))
+	if err := k.gitCommit(gpgID, message); err != nil {
+		return err
+	}
+
+	return k.Reencrypt(dir)
+}
+
+func (k *passKeyring) AddRecipients(dir string, recipients ...string) error {
+	current, err := passRecipients(k.dir, filepath.Join(k.dir, k.prefix, dir))
+	if errors.Is(err, errNoPassRecipients) {
+		current = []string{}
+	} else if err != nil {
+		return err
+	}
+
+	for _, r := range recipients {
+		if !containsString(current, r) {
+			current = append(current, r)
+		}
+	}
+
+	return k.SetRecipients(dir, current)
+}
+
+func (k *passKeyring) RemoveRecipients(dir string, recipients ...string) error {
+	current, err := passRecipients(k.dir, filepath.Join(k.dir, k.prefix, dir))
+	if err != nil {
+		return err
+	}
+
+	remaining := []string{}
+	for _, r := range current {
+		if !containsString(recipients, r) {
+			remaining = append(remaining, r)
+		}
+	}
+
+	return k.SetRecipients(dir, remaining)
+}
+
+// init runs the init command of the pass program, which writes the .gpg-id
+// file of a path relative to the store and re-encrypts the entries below it,
+// committing them once.
+func (k *passKeyring) init(path string, recipients []string) error {
+	init := k.commands().init
+	if init == nil {
+		return fmt.Errorf("Recipients can't be changed with the %s profile, use native mode or %s itself", k.profile, k.passcmd)
+	}
+
+	args := []string{init[0]}
+	if path != "" {
+		args = append(init, path)
+	}
+	_, err := runGPG(k.pass(append(args, recipients...)...))
+
+	return err
+}
+
+// Reencrypt re-encrypts the entries in a directory under the prefix to the
+// recipients currently listed for them, as a single commit.
+func (k *passKeyring) Reencrypt(dir string) error {
+	start := filepath.Join(k.dir, k.prefix, dir)
+
+	if !k.native {
+		// pass init re-encrypts the entries below the .gpg-id file it writes,
+		// which is rewritten as it is
+		recipients, gpgIDDir, err := passGpgID(k.dir, start)
+		if err != nil {
+			return err
+		}
+		path, err := filepath.Rel(k.dir, gpgIDDir)
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			path = ""
+		}
+		return k.init(path, recipients)
+	}
+
+	names := []string{}
+	err := walkPassEntries(start, func(filename string) error {
+		name, err := filepath.Rel(k.dir, strings.TrimSuffix(filename, ".gpg"))
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		data, err := k.show(name)
+		if err != nil {
+			return fmt.Errorf("decrypting %q failed: %v", name, err)
+		}
+		if err = k.nativeInsert(name, data); err != nil {
+			return fmt.Errorf("encrypting %q failed: %v", name, err)
+		}
+	}
+
+	path := filepath.Join(k.prefix, dir)
+	message := "Reencrypt password store."
+	if path != "" {
+		message = fmt.Sprintf("Reencrypt password store (%s).", path)
+	} else {
+		path = "."
+	}
+
+	return k.gitCommit(path, message)
+}
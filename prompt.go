@@ -1,8 +1,11 @@
 package keyring
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"os/exec"
+	"strings"
 
 	"golang.org/x/term"
 )
@@ -25,3 +28,51 @@ func FixedStringPrompt(value string) PromptFunc {
 		return value, nil
 	}
 }
+
+// KeyfilePrompt returns a PromptFunc that reads the password from a file,
+// ignoring a trailing newline. ~/ is resolved to the users' home dir.
+func KeyfilePrompt(filename string) PromptFunc {
+	return func(_ string) (string, error) {
+		filename, err := ExpandTilde(filename)
+		if err != nil {
+			return "", err
+		}
+
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+}
+
+// CommandPrompt returns a PromptFunc that runs a command and uses its output
+// as the password, ignoring a trailing newline.
+func CommandPrompt(name string, args ...string) PromptFunc {
+	return func(_ string) (string, error) {
+		var stderr bytes.Buffer
+		cmd := exec.Command(name, args...)
+		cmd.Stderr = &stderr
+
+		b, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return "", fmt.Errorf("running %s failed: %v: %s", name, err, msg)
+			}
+			return "", fmt.Errorf("running %s failed: %v", name, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+}
+
+// KeyringPrompt returns a PromptFunc that uses the data of an item on
+// another keyring as the password.
+func KeyringPrompt(kr Keyring, key string) PromptFunc {
+	return func(_ string) (string, error) {
+		item, err := kr.Get(key)
+		if err != nil {
+			return "", err
+		}
+		return string(item.Data), nil
+	}
+}
@@ -7,11 +7,27 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-
 	"strings"
+	"unicode/utf8"
 
 	"github.com/godbus/dbus"
-	"github.com/gsterjov/go-libsecret"
+)
+
+// secretsSchema is the xdg:schema of the items we store. Items are looked up by
+// the service and key attributes, so that other tools can find them, e.g.
+//
+//	secret-tool lookup service aws-vault key default
+const secretsSchema = "com.99designs.keyring.Item"
+
+// Attributes of the items we store.
+const (
+	secretsAttrSchema              = "xdg:schema"
+	secretsAttrService             = "service"
+	secretsAttrKey                 = "key"
+	secretsAttrDescription         = "description"
+	secretsAttrNotTrustApplication = "keychain-not-trust-application"
+	secretsAttrNotSynchronizable   = "keychain-not-synchronizable"
+	secretsAttrLegacyProfile       = "profile"
 )
 
 func init() {
@@ -29,14 +45,16 @@ func init() {
 			cfg.LibSecretCollectionName = cfg.ServiceName
 		}
 
-		service, err := libsecret.NewService()
+		conn, err := dbus.SessionBus()
 		if err != nil {
 			return &secretsKeyring{}, err
 		}
 
 		ring := &secretsKeyring{
-			name:    cfg.LibSecretCollectionName,
-			service: service,
+			name:        cfg.LibSecretCollectionName,
+			serviceName: cfg.ServiceName,
+			service:     newSecretsBinding(conn, cfg.LibSecretPromptTimeout),
+			allowPlain:  cfg.LibSecretAllowPlainSession,
 		}
 
 		return ring, ring.openSecrets()
@@ -44,10 +62,12 @@ func init() {
 }
 
 type secretsKeyring struct {
-	name       string
-	service    *libsecret.Service
-	collection *libsecret.Collection
-	session    *libsecret.Session
+	name        string
+	serviceName string
+	service     *secretsBinding
+	collection  dbus.ObjectPath
+	session     *secretsSession
+	allowPlain  bool
 }
 
 var errCollectionNotFound = errors.New("The collection does not exist. Please add a key first")
@@ -73,12 +93,27 @@ func decodeKeyringString(src string) string {
 	return dst.String()
 }
 
+// openSecrets opens a session and finds the collection, if it exists. Both
+// are kept for later calls, see retry. The collection name is looked up as an
+// alias first, so "default" is the user's default collection.
 func (k *secretsKeyring) openSecrets() error {
-	session, err := k.service.Open()
-	if err != nil {
+	if k.session == nil {
+		session, err := openSecretsSession(k.service, k.allowPlain)
+		if err != nil {
+			return err
+		}
+		k.session = session
+	}
+
+	if k.collection != "" {
+		return nil
+	}
+
+	collection, err := k.service.ReadAlias(k.name)
+	if err != nil || collection != "" {
+		k.collection = collection
 		return err
 	}
-	k.session = session
 
 	// get the collection if it already exists
 	collections, err := k.service.Collections()
@@ -86,12 +121,11 @@ func (k *secretsKeyring) openSecrets() error {
 		return err
 	}
 
-	path := libsecret.DBusPath + "/collection/" + k.name
+	path := string(secretsServicePath) + "/collection/" + k.name
 
 	for _, collection := range collections {
-		if decodeKeyringString(string(collection.Path())) == path {
-			c := collection // fix variable into the local variable to ensure it's referenced correctly, see https://github.com/kyoh86/exportloopref
-			k.collection = &c
+		if decodeKeyringString(string(collection)) == path {
+			k.collection = collection
 			return nil
 		}
 	}
@@ -104,18 +138,102 @@ func (k *secretsKeyring) openCollection() error {
 		return err
 	}
 
-	if k.collection == nil {
+	if k.collection == "" {
 		return errCollectionNotFound
-		// return &secretsError{fmt.Sprintf(
-		// 	"The collection %q does not exist. Please add a key first",
-		// 	k.name,
-		// )}
 	}
 
 	return nil
 }
 
+// retry calls fn, and calls it once more with a new session and collection
+// lookup if the ones kept from earlier calls are gone, e.g. because the
+// Secret Service restarted or the collection was deleted.
+func (k *secretsKeyring) retry(fn func() error) error {
+	err := fn()
+	if !secretsIsError(err, secretsErrorNoSuchObject, secretsErrorNoSession) {
+		return err
+	}
+
+	debugf("Secret Service object went away, opening again: %v", err)
+	if k.session != nil {
+		_ = k.service.CloseSession(k.session.path)
+	}
+	k.session = nil
+	k.collection = ""
+
+	return fn()
+}
+
+// attributes returns the attributes identifying the item with a key.
+func (k *secretsKeyring) attributes(key string) map[string]string {
+	return map[string]string{
+		secretsAttrSchema:  secretsSchema,
+		secretsAttrService: k.serviceName,
+		secretsAttrKey:     key,
+	}
+}
+
+// search returns the items with a key, including those stored as JSON by
+// earlier versions, which were found by their "profile" attribute.
+func (k *secretsKeyring) search(key string) ([]dbus.ObjectPath, error) {
+	items, err := k.service.SearchItems(k.collection, k.attributes(key))
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, err := k.service.SearchItems(k.collection, map[string]string{secretsAttrLegacyProfile: key})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(items, legacy...), nil
+}
+
+// find returns the item with a key, preferring the current format whenever
+// there are multiples, or "" if there's none.
+func (k *secretsKeyring) find(key string) (dbus.ObjectPath, error) {
+	items, err := k.service.SearchItems(k.collection, k.attributes(key))
+	if err != nil {
+		return "", err
+	}
+
+	if len(items) == 0 {
+		items, err = k.service.SearchItems(k.collection, map[string]string{secretsAttrLegacyProfile: key})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(items) == 0 {
+		return "", nil
+	}
+
+	return items[0], nil
+}
+
+// ensureUnlocked unlocks an item or collection if it's locked
+func (k *secretsKeyring) ensureUnlocked(path dbus.ObjectPath, iface string) error {
+	locked, err := k.service.Locked(path, iface)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	return k.service.Unlock(path)
+}
+
 func (k *secretsKeyring) Get(key string) (Item, error) {
+	var item Item
+	err := k.retry(func() (err error) {
+		item, err = k.get(key)
+		return err
+	})
+
+	return item, err
+}
+
+func (k *secretsKeyring) get(key string) (Item, error) {
 	if err := k.openCollection(); err != nil {
 		if err == errCollectionNotFound {
 			return Item{}, ErrKeyNotFound
@@ -123,65 +241,131 @@ func (k *secretsKeyring) Get(key string) (Item, error) {
 		return Item{}, err
 	}
 
-	items, err := k.collection.SearchItems(key)
+	item, err := k.find(key)
 	if err != nil {
 		return Item{}, err
 	}
 
-	if len(items) == 0 {
+	if item == "" {
 		return Item{}, ErrKeyNotFound
 	}
 
-	// use the first item whenever there are multiples
-	// with the same profile name
-	item := items[0]
-
-	locked, err := item.Locked()
+	all, err := k.service.ItemProperties(item)
 	if err != nil {
 		return Item{}, err
 	}
+	props := all[0]
 
-	if locked {
+	if props.Locked {
 		if err := k.service.Unlock(item); err != nil {
 			return Item{}, err
 		}
 	}
 
-	secret, err := item.GetSecret(k.session)
+	secret, err := k.service.GetSecret(item, k.session.path)
 	if err != nil {
 		return Item{}, err
 	}
 
-	// pack the secret into the item
-	var ret Item
-	if err = json.Unmarshal(secret.Value, &ret); err != nil {
+	data, err := k.session.decrypt(secret.Parameters, secret.Value)
+	if err != nil {
 		return Item{}, err
 	}
 
-	return ret, err
+	// earlier versions packed the whole item into the secret
+	if _, ok := props.Attributes[secretsAttrKey]; !ok {
+		var ret Item
+		if err = json.Unmarshal(data, &ret); err != nil {
+			return Item{}, err
+		}
+		return ret, nil
+	}
+
+	return secretsItem(key, props, data), nil
 }
 
-// GetMetadata for libsecret returns an error indicating that it's unsupported
-// for this backend.
-//
-// libsecret actually implements a metadata system which we could use, "Secret
-// Attributes"; I found no indication in documentation of anything like an
-// automatically maintained last-modification timestamp, so to use this we'd
-// need to have a SetMetadata API too.  Which we're not yet doing, but feel
-// free to contribute patches.
+// secretsItem builds an Item from the label and attributes of ours.
+func secretsItem(key string, props secretsItemProperties, data []byte) Item {
+	// items without a label are labelled with their key
+	label := props.Label
+	if label == key {
+		label = ""
+	}
+
+	return Item{
+		Key:                         key,
+		Data:                        data,
+		Label:                       label,
+		Description:                 props.Attributes[secretsAttrDescription],
+		KeychainNotTrustApplication: props.Attributes[secretsAttrNotTrustApplication] == "true",
+		KeychainNotSynchronizable:   props.Attributes[secretsAttrNotSynchronizable] == "true",
+	}
+}
+
+// GetMetadata returns the label, attributes and modification time of an item,
+// which the Secret Service shows without unlocking. Items stored as JSON by
+// earlier versions only have their key and modification time.
 func (k *secretsKeyring) GetMetadata(key string) (Metadata, error) {
-	return Metadata{}, ErrMetadataNeedsCredentials
+	var md Metadata
+	err := k.retry(func() (err error) {
+		md, err = k.getMetadata(key)
+		return err
+	})
+
+	return md, err
+}
+
+func (k *secretsKeyring) getMetadata(key string) (Metadata, error) {
+	if err := k.openCollection(); err != nil {
+		if err == errCollectionNotFound {
+			return Metadata{}, ErrKeyNotFound
+		}
+		return Metadata{}, err
+	}
+
+	path, err := k.find(key)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if path == "" {
+		return Metadata{}, ErrKeyNotFound
+	}
+
+	all, err := k.service.ItemProperties(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	props := all[0]
+
+	item := Item{Key: key}
+	if _, ok := props.Attributes[secretsAttrKey]; ok {
+		item = secretsItem(key, props, nil)
+	}
+
+	return Metadata{Item: &item, ModificationTime: props.Modified}, nil
 }
 
 func (k *secretsKeyring) Set(item Item) error {
+	return k.retry(func() error {
+		return k.set(item)
+	})
+}
+
+func (k *secretsKeyring) set(item Item) error {
 	err := k.openSecrets()
 	if err != nil {
 		return err
 	}
 
 	// create the collection if it doesn't already exist
-	if k.collection == nil {
-		collection, err := k.service.CreateCollection(k.name)
+	if k.collection == "" {
+		alias := ""
+		if k.name == "default" {
+			alias = k.name
+		}
+
+		collection, err := k.service.CreateCollection(k.name, alias)
 		if err != nil {
 			return err
 		}
@@ -189,26 +373,72 @@ func (k *secretsKeyring) Set(item Item) error {
 		k.collection = collection
 	}
 
-	if err := k.ensureCollectionUnlocked(); err != nil {
+	if err := k.ensureUnlocked(k.collection, secretsInterfaceCollection); err != nil {
 		return err
 	}
 
-	// create the new item
-	data, err := json.Marshal(item)
+	attributes := k.attributes(item.Key)
+	if item.Description != "" {
+		attributes[secretsAttrDescription] = item.Description
+	}
+	if item.KeychainNotTrustApplication {
+		attributes[secretsAttrNotTrustApplication] = "true"
+	}
+	if item.KeychainNotSynchronizable {
+		attributes[secretsAttrNotSynchronizable] = "true"
+	}
+
+	label := item.Label
+	if label == "" {
+		label = item.Key
+	}
+
+	contentType := "text/plain"
+	if !utf8.Valid(item.Data) {
+		contentType = "application/octet-stream"
+	}
+	parameters, value, err := k.session.encrypt(item.Data)
 	if err != nil {
 		return err
 	}
+	secret := secretsSecret{
+		Session:     k.session.path,
+		Parameters:  parameters,
+		Value:       value,
+		ContentType: contentType,
+	}
 
-	secret := libsecret.NewSecret(k.session, []byte{}, data, "application/json")
+	// replacing matches the attributes, so the description and flags have to
+	// be taken care of by removing any previous items afterwards
+	existing, err := k.search(item.Key)
+	if err != nil {
+		return err
+	}
 
-	if _, err := k.collection.CreateItem(item.Key, secret, true); err != nil {
+	path, err := k.service.CreateItem(k.collection, label, attributes, secret, true)
+	if err != nil {
 		return err
 	}
 
+	for _, old := range existing {
+		if old == path {
+			continue
+		}
+		if err := k.service.Delete(old, secretsInterfaceItem); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (k *secretsKeyring) Remove(key string) error {
+	return k.retry(func() error {
+		return k.remove(key)
+	})
+}
+
+func (k *secretsKeyring) remove(key string) error {
 	if err := k.openCollection(); err != nil {
 		if err == errCollectionNotFound {
 			return ErrKeyNotFound
@@ -216,78 +446,140 @@ func (k *secretsKeyring) Remove(key string) error {
 		return err
 	}
 
-	items, err := k.collection.SearchItems(key)
+	items, err := k.search(key)
 	if err != nil {
 		return err
 	}
 
-	// nothing to delete
 	if len(items) == 0 {
-		return nil
+		return ErrKeyNotFound
 	}
 
-	// we dont want to delete more than one anyway
-	// so just get the first item found
-	item := items[0]
-
-	locked, err := item.Locked()
-	if err != nil {
-		return err
-	}
-
-	if locked {
-		if err := k.service.Unlock(item); err != nil {
+	for _, item := range items {
+		if err := k.ensureUnlocked(item, secretsInterfaceItem); err != nil {
 			return err
 		}
-	}
 
-	if err := item.Delete(); err != nil {
-		return err
+		if err := k.service.Delete(item, secretsInterfaceItem); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// Keys returns the keys of our items in the collection and, like earlier
+// versions, the labels of the legacy JSON items. The Secret Service shows
+// both without unlocking the collection.
 func (k *secretsKeyring) Keys() ([]string, error) {
+	var keys []string
+	err := k.retry(func() (err error) {
+		keys, err = k.keys()
+		return err
+	})
+
+	return keys, err
+}
+
+func (k *secretsKeyring) keys() ([]string, error) {
 	if err := k.openCollection(); err != nil {
 		if err == errCollectionNotFound {
 			return []string{}, nil
 		}
 		return nil, err
 	}
-	if err := k.ensureCollectionUnlocked(); err != nil {
+	items, err := k.service.Items(k.collection)
+	if err != nil {
 		return nil, err
 	}
-	items, err := k.collection.Items()
+	all, err := k.service.ItemProperties(items...)
 	if err != nil {
 		return nil, err
 	}
 	keys := []string{}
-	for _, item := range items {
-		label, err := item.Label() // FIXME: err is being silently ignored
-		if err == nil {
-			keys = append(keys, label)
+	for _, props := range all {
+		key, ok := props.Attributes[secretsAttrKey]
+		switch {
+		case ok && props.Attributes[secretsAttrSchema] == secretsSchema:
+			if props.Attributes[secretsAttrService] != k.serviceName {
+				continue
+			}
+		case props.Attributes[secretsAttrLegacyProfile] != "":
+			key = props.Label
+		default:
+			continue
+		}
+
+		if !containsString(keys, key) {
+			keys = append(keys, key)
 		}
 	}
 	return keys, nil
 }
 
-// deleteCollection deletes the keyring's collection if it exists. This is mainly to support testing.
-func (k *secretsKeyring) deleteCollection() error {
-	if err := k.openCollection(); err != nil {
+// Lock locks the collection. There's nothing to lock if it doesn't exist yet.
+func (k *secretsKeyring) Lock() error {
+	return k.retry(func() error {
+		if err := k.openCollection(); err != nil {
+			if err == errCollectionNotFound {
+				return nil
+			}
+			return err
+		}
+		return k.service.Lock(k.collection)
+	})
+}
+
+// Unlock unlocks the collection, which prompts the user.
+func (k *secretsKeyring) Unlock() error {
+	return k.retry(func() error {
+		if err := k.openCollection(); err != nil {
+			if err == errCollectionNotFound {
+				return nil
+			}
+			return err
+		}
+		return k.ensureUnlocked(k.collection, secretsInterfaceCollection)
+	})
+}
+
+func (k *secretsKeyring) IsLocked() (bool, error) {
+	var locked bool
+	err := k.retry(func() (err error) {
+		if err = k.openCollection(); err != nil {
+			if err == errCollectionNotFound {
+				return nil
+			}
+			return err
+		}
+		locked, err = k.service.Locked(k.collection, secretsInterfaceCollection)
 		return err
+	})
+
+	return locked, err
+}
+
+// Close closes the session. The keyring opens a new one if it's used again.
+func (k *secretsKeyring) Close() error {
+	if k.session == nil {
+		return nil
 	}
-	return k.collection.Delete()
+
+	err := k.service.CloseSession(k.session.path)
+	k.session = nil
+	k.collection = ""
+
+	return err
 }
 
-// unlock the collection if it's locked
-func (k *secretsKeyring) ensureCollectionUnlocked() error {
-	locked, err := k.collection.Locked()
-	if err != nil {
+// deleteCollection deletes the keyring's collection if it exists. This is mainly to support testing.
+func (k *secretsKeyring) deleteCollection() error {
+	if err := k.openCollection(); err != nil {
 		return err
 	}
-	if !locked {
-		return nil
+	if err := k.service.Delete(k.collection, secretsInterfaceCollection); err != nil {
+		return err
 	}
-	return k.service.Unlock(k.collection)
+	k.collection = ""
+	return nil
 }
@@ -4,38 +4,20 @@
 package keyring
 
 import (
-	"os"
+	"encoding/json"
+	"errors"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
-
-	"github.com/gsterjov/go-libsecret"
+	"time"
 )
 
-// NOTE: These tests are not runnable from a headless environment such as
-// Docker or a CI pipeline due to the DBus "prompt" interface being called
-// by the underlying go-libsecret when creating and unlocking a keychain.
-//
-// TODO: Investigate a way to automate the prompting. Some ideas:
-//
-//  1. I've looked extensively but have not found a headless CLI tool that
-//     could be run in the background of eg: a docker container
-//  2. It might be possible to make a mock prompter that connects to DBus
-//     and provides the Prompt interface using the go-libsecret library.
-
 func libSecretSetup(t *testing.T) (Keyring, func(t *testing.T)) {
 	t.Helper()
-	if os.Getenv("GITHUB_ACTIONS") != "" {
-		t.Skip("Skipping testing in CI environment")
-	}
 
-	service, err := libsecret.NewService()
-	if err != nil {
-		t.Fatal(err)
-	}
-	kr := &secretsKeyring{
-		name:    "keyring-test",
-		service: service,
-	}
+	_, kr := libSecretFakeSetup(t)
+
 	return kr, func(t *testing.T) {
 		t.Helper()
 		if err := kr.deleteCollection(); err != nil {
@@ -44,6 +26,21 @@ func libSecretSetup(t *testing.T) (Keyring, func(t *testing.T)) {
 	}
 }
 
+// libSecretFakeSetup returns a keyring using a fake Secret Service on a
+// private bus, so the tests neither need nor touch a real one.
+func libSecretFakeSetup(t *testing.T) (*fakeSecretService, *secretsKeyring) {
+	t.Helper()
+
+	fake, conn := newFakeSecretService(t)
+	kr := &secretsKeyring{
+		name:        "keyring-test",
+		serviceName: "keyring-test",
+		service:     newSecretsBinding(conn, 0),
+	}
+
+	return fake, kr
+}
+
 func TestLibSecretKeysWhenEmpty(t *testing.T) {
 	kr, _ := libSecretSetup(t)
 
@@ -145,6 +142,112 @@ func TestLibSecretRemoveWhenNotEmpty(t *testing.T) {
 	}
 }
 
+func TestLibSecretItemRoundTrip(t *testing.T) {
+	kr, teardown := libSecretSetup(t)
+	defer teardown(t)
+
+	item := Item{
+		Key:                       "llamas",
+		Data:                      []byte("llamas are great"),
+		Label:                     "Llamas",
+		Description:               "The best animals",
+		KeychainNotSynchronizable: true,
+	}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the item doesn't leave duplicates behind
+	item.Description = ""
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := kr.Get(item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(it, item) {
+		t.Fatalf("Expected %#v, got %#v", item, it)
+	}
+
+	// The secret is stored as is, with attributes other tools can look it up by
+	sk := kr.(*secretsKeyring)
+	items, err := sk.service.SearchItems(sk.collection, map[string]string{"service": "keyring-test", "key": "llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(items))
+	}
+	secret, err := sk.service.GetSecret(items[0], sk.session.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := sk.session.decrypt(secret.Parameters, secret.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "llamas are great" {
+		t.Fatalf("Unexpected secret %q", value)
+	}
+}
+
+func TestLibSecretLegacyItem(t *testing.T) {
+	kr, teardown := libSecretSetup(t)
+	defer teardown(t)
+
+	// Store something first so the collection exists
+	if err := kr.Set(Item{Key: "alpacas", Data: []byte("alpacas are better")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Earlier versions stored the item as JSON, labelled and found by the key
+	sk := kr.(*secretsKeyring)
+	legacy := Item{Key: "llamas", Data: []byte("llamas are great"), Description: "The best animals"}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parameters, value, err := sk.session.encrypt(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := secretsSecret{Session: sk.session.path, Parameters: parameters, Value: value, ContentType: "application/json"}
+	if _, err := sk.service.CreateItem(sk.collection, legacy.Key, map[string]string{"profile": legacy.Key}, secret, true); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := kr.Get("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(it, legacy) {
+		t.Fatalf("Expected %#v, got %#v", legacy, it)
+	}
+
+	keys, err := kr.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"alpacas", "llamas"}) {
+		t.Fatalf("Unexpected keys %v", keys)
+	}
+
+	// Setting the item again replaces the legacy one
+	if err := kr.Set(legacy); err != nil {
+		t.Fatal(err)
+	}
+	items, err := sk.search("llamas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Expected 1 item, got %d", len(items))
+	}
+}
+
 func TestLibSpecialCharacters(t *testing.T) {
 	decoded := decodeKeyringString("keyring_2dtest")
 	if decoded != "keyring-test" {
@@ -166,3 +269,255 @@ func TestLibSpecialCharacters(t *testing.T) {
 		t.Fatal("incorrect decodeKeyringString")
 	}
 }
+
+func TestLibSecretPromptDismissed(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+	fake.Configure(func(s *fakeSecretService) { s.DismissPrompts = true })
+
+	err := kr.Set(Item{Key: "llamas", Data: []byte("llamas are great")})
+	if !errors.Is(err, ErrPromptCancelled) {
+		t.Fatalf("Expected ErrPromptCancelled, got: %v", err)
+	}
+	if _, _, ok := fake.Collection("keyring-test"); ok {
+		t.Fatal("Expected the collection not to be created")
+	}
+}
+
+func TestLibSecretPromptTimeout(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+	fake.Configure(func(s *fakeSecretService) { s.IgnorePrompts = true })
+	kr.service.promptTimeout = 100 * time.Millisecond
+
+	err := kr.Set(Item{Key: "llamas", Data: []byte("llamas are great")})
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("Expected a timeout, got: %v", err)
+	}
+	if n := fake.CallCount("Dismiss"); n != 1 {
+		t.Fatalf("Expected the prompt to be dismissed, got %d calls", n)
+	}
+}
+
+func TestLibSecretUnlocksCollection(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great")}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	it, err := kr.Get(item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(it, item) {
+		t.Fatalf("Expected %#v, got %#v", item, it)
+	}
+	if _, locked, _ := fake.Collection("keyring-test"); locked {
+		t.Fatal("Expected the collection to be unlocked")
+	}
+
+	// Locked items can't be read or removed when the user refuses to unlock
+	fake.Lock()
+	fake.Configure(func(s *fakeSecretService) { s.DismissPrompts = true })
+	if _, err := kr.Get(item.Key); !errors.Is(err, ErrPromptCancelled) {
+		t.Fatalf("Expected ErrPromptCancelled, got: %v", err)
+	}
+	if err := kr.Remove(item.Key); !errors.Is(err, ErrPromptCancelled) {
+		t.Fatalf("Expected ErrPromptCancelled, got: %v", err)
+	}
+}
+
+func TestLibSecretDefaultAlias(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+	fake.AddCollection("Login", "default", false)
+	kr.name = "default"
+
+	if err := kr.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.CallCount("CreateCollection") != 0 {
+		t.Fatal("Expected the default collection to be used")
+	}
+	if n, _, _ := fake.Collection("Login"); n != 1 {
+		t.Fatalf("Expected 1 item in the default collection, got %d", n)
+	}
+}
+
+func TestLibSecretPlainSession(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+	fake.Configure(func(s *fakeSecretService) { s.PlainOnly = true })
+
+	if err := kr.openSecrets(); err == nil {
+		t.Fatal("Expected plain sessions to be refused")
+	}
+
+	kr.allowPlain = true
+	item := Item{Key: "llamas", Data: []byte("llamas are great")}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+	it, err := kr.Get(item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(it, item) {
+		t.Fatalf("Expected %#v, got %#v", item, it)
+	}
+	if alg := fake.LastAlgorithm(); alg != secretsAlgorithmPlain {
+		t.Fatalf("Expected a plain session, got %s", alg)
+	}
+}
+
+func TestLibSecretGetMetadata(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+
+	if _, err := kr.GetMetadata("llamas"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got: %v", err)
+	}
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great"), Label: "Llamas", Description: "The best animals"}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata doesn't need the collection unlocked
+	fake.Lock()
+	fake.Configure(func(s *fakeSecretService) { s.DismissPrompts = true })
+	md, err := kr.GetMetadata(item.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Data = nil
+	if !reflect.DeepEqual(*md.Item, item) {
+		t.Fatalf("Expected %#v, got %#v", item, *md.Item)
+	}
+	if md.ModificationTime.IsZero() {
+		t.Fatal("Expected a modification time")
+	}
+}
+
+func TestLibSecretReusesSession(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great")}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := kr.Get(item.Key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kr.Keys(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := fake.CallCount("OpenSession"); n != 1 {
+		t.Fatalf("Expected 1 session to be opened, got %d", n)
+	}
+	if n := fake.CallCount("ReadAlias"); n != 1 {
+		t.Fatalf("Expected the collection to be looked up once, got %d", n)
+	}
+}
+
+func TestLibSecretReopensAfterRestart(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great")}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session is gone after a restart of the service
+	fake.CloseSessions()
+	if _, err := kr.Get(item.Key); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.CallCount("OpenSession"); n != 2 {
+		t.Fatalf("Expected a new session to be opened, got %d sessions", n)
+	}
+
+	// The collection is gone after someone else deleted it
+	other := &secretsKeyring{name: kr.name, serviceName: kr.serviceName, service: kr.service}
+	if err := other.deleteCollection(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.Get(item.Key); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got: %v", err)
+	}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := fake.Collection("keyring-test"); n != 1 {
+		t.Fatalf("Expected the collection to be created again with 1 item, got %d", n)
+	}
+}
+
+func TestLibSecretKeysReportsErrors(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+
+	if err := kr.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Configure(func(s *fakeSecretService) { s.FailProperties = true })
+	if _, err := kr.Keys(); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("Expected the failure to be reported, got: %v", err)
+	}
+}
+
+func TestLibSecretLock(t *testing.T) {
+	_, kr := libSecretFakeSetup(t)
+
+	var l Locker = kr
+	if locked, err := l.IsLocked(); err != nil || locked {
+		t.Fatalf("Expected a missing collection to be unlocked, got %v, %v", locked, err)
+	}
+
+	if err := kr.Set(Item{Key: "llamas", Data: []byte("llamas are great")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := l.IsLocked(); err != nil || !locked {
+		t.Fatalf("Expected the collection to be locked, got %v, %v", locked, err)
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := l.IsLocked(); err != nil || locked {
+		t.Fatalf("Expected the collection to be unlocked, got %v, %v", locked, err)
+	}
+}
+
+func TestLibSecretClose(t *testing.T) {
+	fake, kr := libSecretFakeSetup(t)
+
+	item := Item{Key: "llamas", Data: []byte("llamas are great")}
+	if err := kr.Set(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.CallCount("Session.Close"); n != 1 {
+		t.Fatalf("Expected the session to be closed, got %d calls", n)
+	}
+	if err := kr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new session is opened when the keyring is used again
+	if _, err := kr.Get(item.Key); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.CallCount("OpenSession"); n != 2 {
+		t.Fatalf("Expected a new session to be opened, got %d sessions", n)
+	}
+}
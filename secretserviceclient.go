@@ -0,0 +1,374 @@
+//go:build linux
+// +build linux
+
+package keyring
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+// D-Bus names of the Secret Service API, see
+// https://specifications.freedesktop.org/secret-service/latest/
+const (
+	secretsServiceName         = "org.freedesktop.secrets"
+	secretsServicePath         = dbus.ObjectPath("/org/freedesktop/secrets")
+	secretsInterfaceService    = "org.freedesktop.Secret.Service"
+	secretsInterfaceCollection = "org.freedesktop.Secret.Collection"
+	secretsInterfaceItem       = "org.freedesktop.Secret.Item"
+	secretsInterfaceSession    = "org.freedesktop.Secret.Session"
+	secretsInterfacePrompt     = "org.freedesktop.Secret.Prompt"
+)
+
+// Errors of the Secret Service API.
+const (
+	secretsErrorNoSuchObject = "org.freedesktop.Secret.Error.NoSuchObject"
+	secretsErrorNoSession    = "org.freedesktop.Secret.Error.NoSession"
+)
+
+// secretsNoPath is the path returned where no object applies, e.g. when no
+// prompt is necessary.
+const secretsNoPath = dbus.ObjectPath("/")
+
+// secretsSecret is the Secret struct of the API, (oayays) on the wire.
+type secretsSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// secretsItemProperties are the properties of an item.
+type secretsItemProperties struct {
+	Label      string
+	Attributes map[string]string
+	Locked     bool
+	Modified   time.Time
+}
+
+// Dbus bindings for the Secret Service with types.
+type secretsBinding struct {
+	conn          *dbus.Conn
+	promptTimeout time.Duration
+}
+
+func newSecretsBinding(conn *dbus.Conn, promptTimeout time.Duration) *secretsBinding {
+	return &secretsBinding{conn: conn, promptTimeout: promptTimeout}
+}
+
+func (s *secretsBinding) object(path dbus.ObjectPath) dbus.BusObject {
+	return s.conn.Object(secretsServiceName, path)
+}
+
+func (s *secretsBinding) property(path dbus.ObjectPath, name string) (dbus.Variant, error) {
+	return s.object(path).GetProperty(name)
+}
+
+// method (Variant output, ObjectPath result) org.freedesktop.Secret.Service.OpenSession(String algorithm, Variant input)
+func (s *secretsBinding) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, error) {
+	var output dbus.Variant
+	var path dbus.ObjectPath
+	err := s.object(secretsServicePath).Call(secretsInterfaceService+".OpenSession", 0, algorithm, input).Store(&output, &path)
+
+	return output, path, err
+}
+
+// method org.freedesktop.Secret.Session.Close()
+func (s *secretsBinding) CloseSession(session dbus.ObjectPath) error {
+	return s.object(session).Call(secretsInterfaceSession+".Close", 0).Err
+}
+
+// property Array<ObjectPath> org.freedesktop.Secret.Service.Collections
+func (s *secretsBinding) Collections() ([]dbus.ObjectPath, error) {
+	val, err := s.property(secretsServicePath, secretsInterfaceService+".Collections")
+	if err != nil {
+		return nil, err
+	}
+
+	paths, ok := val.Value().([]dbus.ObjectPath)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected type %s of Collections", val.Signature())
+	}
+
+	return paths, nil
+}
+
+// method (ObjectPath collection) org.freedesktop.Secret.Service.ReadAlias(String name)
+//
+// Returns "" when there is no collection with the alias.
+func (s *secretsBinding) ReadAlias(name string) (dbus.ObjectPath, error) {
+	var path dbus.ObjectPath
+	if err := s.object(secretsServicePath).Call(secretsInterfaceService+".ReadAlias", 0, name).Store(&path); err != nil {
+		return "", err
+	}
+	if path == secretsNoPath {
+		return "", nil
+	}
+
+	return path, nil
+}
+
+// method (ObjectPath collection, ObjectPath prompt) org.freedesktop.Secret.Service.CreateCollection(Dict<String,Variant> properties, String alias)
+func (s *secretsBinding) CreateCollection(label string, alias string) (dbus.ObjectPath, error) {
+	properties := map[string]dbus.Variant{
+		secretsInterfaceCollection + ".Label": dbus.MakeVariant(label),
+	}
+
+	var path, prompt dbus.ObjectPath
+	err := s.object(secretsServicePath).Call(secretsInterfaceService+".CreateCollection", 0, properties, alias).Store(&path, &prompt)
+	if err != nil {
+		return "", err
+	}
+
+	if prompt != secretsNoPath {
+		result, err := s.Prompt(prompt)
+		if err != nil {
+			return "", err
+		}
+		if path, err = secretsPromptPath(result); err != nil {
+			return "", err
+		}
+	}
+
+	return path, nil
+}
+
+// method (Array<ObjectPath> unlocked, ObjectPath prompt) org.freedesktop.Secret.Service.Unlock(Array<ObjectPath> objects)
+func (s *secretsBinding) Unlock(objects ...dbus.ObjectPath) error {
+	return s.lockOrUnlock("Unlock", objects)
+}
+
+// method (Array<ObjectPath> locked, ObjectPath prompt) org.freedesktop.Secret.Service.Lock(Array<ObjectPath> objects)
+func (s *secretsBinding) Lock(objects ...dbus.ObjectPath) error {
+	return s.lockOrUnlock("Lock", objects)
+}
+
+func (s *secretsBinding) lockOrUnlock(method string, objects []dbus.ObjectPath) error {
+	var done []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err := s.object(secretsServicePath).Call(secretsInterfaceService+"."+method, 0, objects).Store(&done, &prompt)
+	if err != nil {
+		return err
+	}
+
+	if prompt != secretsNoPath {
+		_, err = s.Prompt(prompt)
+	}
+
+	return err
+}
+
+// property Boolean Locked of collections and items
+func (s *secretsBinding) Locked(path dbus.ObjectPath, iface string) (bool, error) {
+	val, err := s.property(path, iface+".Locked")
+	if err != nil {
+		return true, err
+	}
+
+	locked, ok := val.Value().(bool)
+	if !ok {
+		return true, fmt.Errorf("Unexpected type %s of Locked", val.Signature())
+	}
+
+	return locked, nil
+}
+
+// method (Array<ObjectPath> results) org.freedesktop.Secret.Collection.SearchItems(Dict<String,String> attributes)
+func (s *secretsBinding) SearchItems(collection dbus.ObjectPath, attributes map[string]string) ([]dbus.ObjectPath, error) {
+	var paths []dbus.ObjectPath
+	err := s.object(collection).Call(secretsInterfaceCollection+".SearchItems", 0, attributes).Store(&paths)
+
+	return paths, err
+}
+
+// property Array<ObjectPath> org.freedesktop.Secret.Collection.Items
+func (s *secretsBinding) Items(collection dbus.ObjectPath) ([]dbus.ObjectPath, error) {
+	val, err := s.property(collection, secretsInterfaceCollection+".Items")
+	if err != nil {
+		return nil, err
+	}
+
+	paths, ok := val.Value().([]dbus.ObjectPath)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected type %s of Items", val.Signature())
+	}
+
+	return paths, nil
+}
+
+// method (ObjectPath item, ObjectPath prompt) org.freedesktop.Secret.Collection.CreateItem(Dict<String,Variant> properties, Secret secret, Boolean replace)
+func (s *secretsBinding) CreateItem(collection dbus.ObjectPath, label string, attributes map[string]string, secret secretsSecret, replace bool) (dbus.ObjectPath, error) {
+	properties := map[string]dbus.Variant{
+		secretsInterfaceItem + ".Label":      dbus.MakeVariant(label),
+		secretsInterfaceItem + ".Attributes": dbus.MakeVariant(attributes),
+	}
+
+	var path, prompt dbus.ObjectPath
+	err := s.object(collection).Call(secretsInterfaceCollection+".CreateItem", 0, properties, secret, replace).Store(&path, &prompt)
+	if err != nil {
+		return "", err
+	}
+
+	if prompt != secretsNoPath {
+		result, err := s.Prompt(prompt)
+		if err != nil {
+			return "", err
+		}
+		if path, err = secretsPromptPath(result); err != nil {
+			return "", err
+		}
+	}
+
+	return path, nil
+}
+
+// method (ObjectPath prompt) Delete() of collections and items
+func (s *secretsBinding) Delete(path dbus.ObjectPath, iface string) error {
+	var prompt dbus.ObjectPath
+	if err := s.object(path).Call(iface+".Delete", 0).Store(&prompt); err != nil {
+		return err
+	}
+
+	if prompt != secretsNoPath {
+		_, err := s.Prompt(prompt)
+		return err
+	}
+
+	return nil
+}
+
+// method (Secret secret) org.freedesktop.Secret.Item.GetSecret(ObjectPath session)
+func (s *secretsBinding) GetSecret(item dbus.ObjectPath, session dbus.ObjectPath) (secretsSecret, error) {
+	var secret secretsSecret
+	err := s.object(item).Call(secretsInterfaceItem+".GetSecret", 0, session).Store(&secret)
+
+	return secret, err
+}
+
+// method (Dict<String,Variant> props) org.freedesktop.DBus.Properties.GetAll(String interface)
+//
+// ItemProperties reads the properties of items with one call each, sending
+// all the calls before waiting for any replies.
+func (s *secretsBinding) ItemProperties(items ...dbus.ObjectPath) ([]secretsItemProperties, error) {
+	calls := make([]*dbus.Call, len(items))
+	for i, item := range items {
+		calls[i] = s.object(item).Go("org.freedesktop.DBus.Properties.GetAll", 0, nil, secretsInterfaceItem)
+	}
+
+	ret := make([]secretsItemProperties, len(items))
+	for i, call := range calls {
+		<-call.Done
+
+		var props map[string]dbus.Variant
+		if err := call.Store(&props); err != nil {
+			return nil, fmt.Errorf("Failed to read the properties of %s: %w", items[i], err)
+		}
+
+		var err error
+		if ret[i], err = secretsParseItemProperties(props); err != nil {
+			return nil, fmt.Errorf("Failed to read the properties of %s: %w", items[i], err)
+		}
+	}
+
+	return ret, nil
+}
+
+func secretsParseItemProperties(props map[string]dbus.Variant) (secretsItemProperties, error) {
+	var ret secretsItemProperties
+	var ok bool
+	if ret.Label, ok = props["Label"].Value().(string); !ok {
+		return ret, fmt.Errorf("Unexpected type %s of Label", props["Label"].Signature())
+	}
+	if ret.Attributes, ok = props["Attributes"].Value().(map[string]string); !ok {
+		return ret, fmt.Errorf("Unexpected type %s of Attributes", props["Attributes"].Signature())
+	}
+	if ret.Locked, ok = props["Locked"].Value().(bool); !ok {
+		return ret, fmt.Errorf("Unexpected type %s of Locked", props["Locked"].Signature())
+	}
+	modified, ok := props["Modified"].Value().(uint64)
+	if !ok {
+		return ret, fmt.Errorf("Unexpected type %s of Modified", props["Modified"].Signature())
+	}
+	ret.Modified = time.Unix(int64(modified), 0)
+
+	return ret, nil
+}
+
+// method org.freedesktop.Secret.Prompt.Prompt(String window-id)
+//
+// Prompt shows a prompt and waits for its Completed signal, returning its
+// result. Dismissed prompts return ErrPromptCancelled, and prompts that take
+// longer than the timeout are dismissed.
+func (s *secretsBinding) Prompt(prompt dbus.ObjectPath) (dbus.Variant, error) {
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(secretsInterfacePrompt),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := s.conn.AddMatchSignal(match...); err != nil {
+		return dbus.Variant{}, err
+	}
+	defer func() { _ = s.conn.RemoveMatchSignal(match...) }()
+
+	// subscribe before prompting, so the signal can't be missed
+	signals := make(chan *dbus.Signal, 10)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.object(prompt).Call(secretsInterfacePrompt+".Prompt", 0, "").Err; err != nil {
+		return dbus.Variant{}, err
+	}
+
+	var timeout <-chan time.Time
+	if s.promptTimeout > 0 {
+		timer := time.NewTimer(s.promptTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Path != prompt || signal.Name != secretsInterfacePrompt+".Completed" || len(signal.Body) != 2 {
+				continue
+			}
+			if dismissed, _ := signal.Body[0].(bool); dismissed {
+				return dbus.Variant{}, ErrPromptCancelled
+			}
+			result, _ := signal.Body[1].(dbus.Variant)
+			return result, nil
+		case <-timeout:
+			_ = s.object(prompt).Call(secretsInterfacePrompt+".Dismiss", 0).Err
+			return dbus.Variant{}, fmt.Errorf("Timed out after %v waiting for the Secret Service prompt", s.promptTimeout)
+		}
+	}
+}
+
+// secretsPromptPath returns the object a prompt created.
+func secretsPromptPath(result dbus.Variant) (dbus.ObjectPath, error) {
+	path, ok := result.Value().(dbus.ObjectPath)
+	if !ok {
+		return "", errors.New("Unexpected result from the Secret Service prompt")
+	}
+
+	return path, nil
+}
+
+// secretsIsError reports whether err is a D-Bus error with one of the names.
+func secretsIsError(err error, names ...string) bool {
+	var dbusErr dbus.Error
+	if !errors.As(err, &dbusErr) {
+		return false
+	}
+
+	for _, name := range names {
+		if dbusErr.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,714 @@
+//go:build linux
+// +build linux
+
+package keyring
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+// A Secret Service for tests, keeping collections in memory. It is served on
+// a private bus, see startTestBus, so tests don't need, or touch, the user's
+// keyring.
+
+var (
+	errFakeSecretsNoSuchObject = dbus.NewError("org.freedesktop.Secret.Error.NoSuchObject", []interface{}{"No such object"})
+	errFakeSecretsIsLocked     = dbus.NewError("org.freedesktop.Secret.Error.IsLocked", []interface{}{"Object is locked"})
+	errFakeSecretsNoSession    = dbus.NewError("org.freedesktop.Secret.Error.NoSession", []interface{}{"No such session"})
+	errFakeSecretsNotSupported = dbus.NewError("org.freedesktop.DBus.Error.NotSupported", []interface{}{"Algorithm not supported"})
+)
+
+type fakeSecretsCollection struct {
+	label    string
+	locked   bool
+	items    map[dbus.ObjectPath]*fakeSecretsItem
+	created  uint64
+	modified uint64
+}
+
+type fakeSecretsItem struct {
+	label       string
+	attributes  map[string]string
+	secret      []byte
+	contentType string
+	created     uint64
+	modified    uint64
+}
+
+type fakeSecretService struct {
+	mu          sync.Mutex
+	conn        *dbus.Conn
+	collections map[dbus.ObjectPath]*fakeSecretsCollection
+	aliases     map[string]dbus.ObjectPath
+	sessions    map[dbus.ObjectPath]*secretsSession
+	prompts     map[dbus.ObjectPath]func() dbus.Variant
+	counter     int
+
+	// Scriptable behaviour, see Configure
+
+	// PlainOnly makes the service refuse encrypted sessions
+	PlainOnly bool
+	// DismissPrompts makes the user dismiss every prompt
+	DismissPrompts bool
+	// IgnorePrompts makes the user never answer prompts
+	IgnorePrompts bool
+	// FailProperties makes reading the properties of items fail
+	FailProperties bool
+
+	// Calls counts the method calls received, by method name
+	Calls map[string]int
+	// Algorithms are the algorithms sessions were opened with
+	Algorithms []string
+}
+
+// newFakeSecretService serves a fake Secret Service on a new private bus,
+// returning it and a client connection to the bus.
+func newFakeSecretService(t *testing.T) (*fakeSecretService, *dbus.Conn) {
+	t.Helper()
+
+	address := startTestBus(t)
+	s := &fakeSecretService{
+		conn:        dialTestBus(t, address),
+		collections: map[dbus.ObjectPath]*fakeSecretsCollection{},
+		aliases:     map[string]dbus.ObjectPath{},
+		sessions:    map[dbus.ObjectPath]*secretsSession{},
+		prompts:     map[dbus.ObjectPath]func() dbus.Variant{},
+		Calls:       map[string]int{},
+	}
+
+	exports := map[string]interface{}{
+		secretsInterfaceService:           fakeSecretsServiceAPI{s},
+		secretsInterfaceCollection:        fakeSecretsCollectionAPI{s},
+		secretsInterfaceItem:              fakeSecretsItemAPI{s},
+		secretsInterfaceSession:           fakeSecretsSessionAPI{s},
+		secretsInterfacePrompt:            fakeSecretsPromptAPI{s},
+		"org.freedesktop.DBus.Properties": fakeSecretsPropertiesAPI{s},
+	}
+	for iface, v := range exports {
+		if err := s.conn.ExportSubtree(v, secretsServicePath, iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply, err := s.conn.RequestName(secretsServiceName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("Unable to own %s", secretsServiceName)
+	}
+
+	return s, dialTestBus(t, address)
+}
+
+// AddCollection adds a collection, optionally with an alias.
+func (s *fakeSecretService) AddCollection(label string, alias string, locked bool) dbus.ObjectPath {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addCollection(label, alias, locked)
+}
+
+func (s *fakeSecretService) addCollection(label string, alias string, locked bool) dbus.ObjectPath {
+	path := secretsServicePath + "/collection/" + dbus.ObjectPath(strings.ReplaceAll(label, "-", "_2d"))
+	if _, ok := s.collections[path]; ok {
+		s.counter++
+		path = dbus.ObjectPath(fmt.Sprintf("%s%d", path, s.counter))
+	}
+
+	now := uint64(time.Now().Unix())
+	s.collections[path] = &fakeSecretsCollection{
+		label:    label,
+		locked:   locked,
+		items:    map[dbus.ObjectPath]*fakeSecretsItem{},
+		created:  now,
+		modified: now,
+	}
+	if alias != "" {
+		s.aliases[alias] = path
+	}
+
+	return path
+}
+
+// Lock locks all the collections.
+func (s *fakeSecretService) Lock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.collections {
+		c.locked = true
+	}
+}
+
+// Collection returns the number of items in a collection and whether it's
+// locked, with ok false if there is no collection with the label.
+func (s *fakeSecretService) Collection(label string) (items int, locked bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.collections {
+		if c.label == label {
+			return len(c.items), c.locked, true
+		}
+	}
+
+	return 0, false, false
+}
+
+// CloseSessions closes all sessions, like a restart of the service would.
+func (s *fakeSecretService) CloseSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions = map[dbus.ObjectPath]*secretsSession{}
+}
+
+// Configure changes the scriptable behaviour.
+func (s *fakeSecretService) Configure(f func(s *fakeSecretService)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f(s)
+}
+
+// CallCount returns how often a method was called.
+func (s *fakeSecretService) CallCount(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Calls[method]
+}
+
+// LastAlgorithm returns the algorithm of the last session opened.
+func (s *fakeSecretService) LastAlgorithm() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.Algorithms) == 0 {
+		return ""
+	}
+	return s.Algorithms[len(s.Algorithms)-1]
+}
+
+func (s *fakeSecretService) called(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Calls[method]++
+}
+
+func (s *fakeSecretService) nextPath(kind string) dbus.ObjectPath {
+	s.counter++
+	return dbus.ObjectPath(fmt.Sprintf("%s/%s/%d", secretsServicePath, kind, s.counter))
+}
+
+// prompt registers a prompt, which performs the action when the user accepts it.
+func (s *fakeSecretService) prompt(action func() dbus.Variant) dbus.ObjectPath {
+	path := s.nextPath("prompt")
+	s.prompts[path] = action
+
+	return path
+}
+
+// lookup returns the collection and item at a path, where item is nil for
+// collections.
+func (s *fakeSecretService) lookup(path dbus.ObjectPath) (*fakeSecretsCollection, *fakeSecretsItem, *dbus.Error) {
+	if c, ok := s.collections[path]; ok {
+		return c, nil, nil
+	}
+
+	c, ok := s.collections[path[:strings.LastIndex(string(path), "/")]]
+	if !ok {
+		return nil, nil, errFakeSecretsNoSuchObject
+	}
+	item, ok := c.items[path]
+	if !ok {
+		return nil, nil, errFakeSecretsNoSuchObject
+	}
+
+	return c, item, nil
+}
+
+func fakeSecretsPath(msg dbus.Message) dbus.ObjectPath {
+	path, _ := msg.Headers[dbus.FieldPath].Value().(dbus.ObjectPath)
+	return path
+}
+
+func fakeSecretsMatch(item *fakeSecretsItem, attributes map[string]string) bool {
+	for k, v := range attributes {
+		if item.attributes[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+type fakeSecretsServiceAPI struct{ s *fakeSecretService }
+
+func (a fakeSecretsServiceAPI) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	a.s.called("OpenSession")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	a.s.Algorithms = append(a.s.Algorithms, algorithm)
+	path := a.s.nextPath("session")
+
+	switch {
+	case algorithm == secretsAlgorithmPlain:
+		a.s.sessions[path] = &secretsSession{path: path}
+		return dbus.MakeVariant(""), path, nil
+	case algorithm == secretsAlgorithmDH && !a.s.PlainOnly:
+		clientPublic, ok := input.Value().([]byte)
+		if !ok {
+			return dbus.Variant{}, "", dbus.MakeFailedError(fmt.Errorf("invalid input"))
+		}
+		private, public, err := secretsDHKeyPair()
+		if err != nil {
+			return dbus.Variant{}, "", dbus.MakeFailedError(err)
+		}
+		key, err := secretsDHKey(private, clientPublic)
+		if err != nil {
+			return dbus.Variant{}, "", dbus.MakeFailedError(err)
+		}
+		a.s.sessions[path] = &secretsSession{path: path, key: key}
+		return dbus.MakeVariant(public), path, nil
+	}
+
+	return dbus.Variant{}, "", errFakeSecretsNotSupported
+}
+
+func (a fakeSecretsServiceAPI) CreateCollection(properties map[string]dbus.Variant, alias string) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	a.s.called("CreateCollection")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	label, _ := properties[secretsInterfaceCollection+".Label"].Value().(string)
+
+	// Like gnome-keyring, asking for the password of the new collection
+	prompt := a.s.prompt(func() dbus.Variant {
+		return dbus.MakeVariant(a.s.addCollection(label, alias, false))
+	})
+
+	return secretsNoPath, prompt, nil
+}
+
+func (a fakeSecretsServiceAPI) ReadAlias(name string) (dbus.ObjectPath, *dbus.Error) {
+	a.s.called("ReadAlias")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	if path, ok := a.s.aliases[name]; ok {
+		return path, nil
+	}
+
+	return secretsNoPath, nil
+}
+
+func (a fakeSecretsServiceAPI) SetAlias(name string, collection dbus.ObjectPath) *dbus.Error {
+	a.s.called("SetAlias")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	a.s.aliases[name] = collection
+	return nil
+}
+
+func (a fakeSecretsServiceAPI) SearchItems(attributes map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	a.s.called("Service.SearchItems")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	unlocked, locked := []dbus.ObjectPath{}, []dbus.ObjectPath{}
+	for _, c := range a.s.collections {
+		for path, item := range c.items {
+			if !fakeSecretsMatch(item, attributes) {
+				continue
+			}
+			if c.locked {
+				locked = append(locked, path)
+			} else {
+				unlocked = append(unlocked, path)
+			}
+		}
+	}
+
+	return unlocked, locked, nil
+}
+
+func (a fakeSecretsServiceAPI) Unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	a.s.called("Unlock")
+	return a.setLocked(objects, false)
+}
+
+func (a fakeSecretsServiceAPI) Lock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	a.s.called("Lock")
+	return a.setLocked(objects, true)
+}
+
+func (a fakeSecretsServiceAPI) setLocked(objects []dbus.ObjectPath, locked bool) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	done, pending := []dbus.ObjectPath{}, []*fakeSecretsCollection{}
+	for _, path := range objects {
+		c, _, err := a.s.lookup(path)
+		if err != nil {
+			return nil, "", err
+		}
+		if c.locked == locked {
+			done = append(done, path)
+		} else if locked {
+			c.locked = true
+			done = append(done, path)
+		} else {
+			pending = append(pending, c)
+		}
+	}
+
+	if len(pending) == 0 {
+		return done, secretsNoPath, nil
+	}
+
+	// Unlocking asks for the password
+	prompt := a.s.prompt(func() dbus.Variant {
+		for _, c := range pending {
+			c.locked = false
+		}
+		return dbus.MakeVariant(objects)
+	})
+
+	return done, prompt, nil
+}
+
+func (a fakeSecretsServiceAPI) GetSecrets(items []dbus.ObjectPath, session dbus.ObjectPath) (map[dbus.ObjectPath]secretsSecret, *dbus.Error) {
+	a.s.called("GetSecrets")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	secrets := map[dbus.ObjectPath]secretsSecret{}
+	for _, path := range items {
+		c, item, err := a.s.lookup(path)
+		if err != nil || item == nil || c.locked {
+			continue
+		}
+		secret, err := a.s.encrypt(item, session)
+		if err != nil {
+			return nil, err
+		}
+		secrets[path] = secret
+	}
+
+	return secrets, nil
+}
+
+func (s *fakeSecretService) encrypt(item *fakeSecretsItem, session dbus.ObjectPath) (secretsSecret, *dbus.Error) {
+	sess, ok := s.sessions[session]
+	if !ok {
+		return secretsSecret{}, errFakeSecretsNoSession
+	}
+
+	parameters, value, err := sess.encrypt(item.secret)
+	if err != nil {
+		return secretsSecret{}, dbus.MakeFailedError(err)
+	}
+
+	return secretsSecret{Session: session, Parameters: parameters, Value: value, ContentType: item.contentType}, nil
+}
+
+type fakeSecretsCollectionAPI struct{ s *fakeSecretService }
+
+func (a fakeSecretsCollectionAPI) collection(msg dbus.Message) (*fakeSecretsCollection, *dbus.Error) {
+	c, item, err := a.s.lookup(fakeSecretsPath(msg))
+	if err != nil {
+		return nil, err
+	}
+	if item != nil {
+		return nil, errFakeSecretsNoSuchObject
+	}
+
+	return c, nil
+}
+
+func (a fakeSecretsCollectionAPI) SearchItems(msg dbus.Message, attributes map[string]string) ([]dbus.ObjectPath, *dbus.Error) {
+	a.s.called("SearchItems")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	c, err := a.collection(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []dbus.ObjectPath{}
+	for path, item := range c.items {
+		if fakeSecretsMatch(item, attributes) {
+			results = append(results, path)
+		}
+	}
+
+	return results, nil
+}
+
+func (a fakeSecretsCollectionAPI) CreateItem(msg dbus.Message, properties map[string]dbus.Variant, secret secretsSecret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	a.s.called("CreateItem")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	c, err := a.collection(msg)
+	if err != nil {
+		return "", "", err
+	}
+	if c.locked {
+		return "", "", errFakeSecretsIsLocked
+	}
+
+	session, ok := a.s.sessions[secret.Session]
+	if !ok {
+		return "", "", errFakeSecretsNoSession
+	}
+	value, decryptErr := session.decrypt(secret.Parameters, secret.Value)
+	if decryptErr != nil {
+		return "", "", dbus.MakeFailedError(decryptErr)
+	}
+
+	label, _ := properties[secretsInterfaceItem+".Label"].Value().(string)
+	attributes, _ := properties[secretsInterfaceItem+".Attributes"].Value().(map[string]string)
+
+	now := uint64(time.Now().Unix())
+	item := &fakeSecretsItem{
+		label:       label,
+		attributes:  attributes,
+		secret:      value,
+		contentType: secret.ContentType,
+		created:     now,
+		modified:    now,
+	}
+
+	if replace {
+		for path, existing := range c.items {
+			if fakeSecretsMatch(existing, attributes) && len(existing.attributes) == len(attributes) {
+				item.created = existing.created
+				c.items[path] = item
+				return path, secretsNoPath, nil
+			}
+		}
+	}
+
+	path := fakeSecretsPath(msg) + dbus.ObjectPath(fmt.Sprintf("/%d", len(c.items)+a.s.counter+1))
+	a.s.counter++
+	c.items[path] = item
+	c.modified = now
+
+	return path, secretsNoPath, nil
+}
+
+func (a fakeSecretsCollectionAPI) Delete(msg dbus.Message) (dbus.ObjectPath, *dbus.Error) {
+	a.s.called("Collection.Delete")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	path := fakeSecretsPath(msg)
+	if _, err := a.collection(msg); err != nil {
+		return "", err
+	}
+
+	delete(a.s.collections, path)
+	for alias, p := range a.s.aliases {
+		if p == path {
+			delete(a.s.aliases, alias)
+		}
+	}
+
+	return secretsNoPath, nil
+}
+
+type fakeSecretsItemAPI struct{ s *fakeSecretService }
+
+func (a fakeSecretsItemAPI) item(msg dbus.Message) (*fakeSecretsCollection, *fakeSecretsItem, *dbus.Error) {
+	c, item, err := a.s.lookup(fakeSecretsPath(msg))
+	if err != nil {
+		return nil, nil, err
+	}
+	if item == nil {
+		return nil, nil, errFakeSecretsNoSuchObject
+	}
+
+	return c, item, nil
+}
+
+func (a fakeSecretsItemAPI) GetSecret(msg dbus.Message, session dbus.ObjectPath) (secretsSecret, *dbus.Error) {
+	a.s.called("GetSecret")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	c, item, err := a.item(msg)
+	if err != nil {
+		return secretsSecret{}, err
+	}
+	if c.locked {
+		return secretsSecret{}, errFakeSecretsIsLocked
+	}
+
+	return a.s.encrypt(item, session)
+}
+
+func (a fakeSecretsItemAPI) Delete(msg dbus.Message) (dbus.ObjectPath, *dbus.Error) {
+	a.s.called("Item.Delete")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	c, _, err := a.item(msg)
+	if err != nil {
+		return "", err
+	}
+	if c.locked {
+		return "", errFakeSecretsIsLocked
+	}
+
+	delete(c.items, fakeSecretsPath(msg))
+	return secretsNoPath, nil
+}
+
+type fakeSecretsSessionAPI struct{ s *fakeSecretService }
+
+func (a fakeSecretsSessionAPI) Close(msg dbus.Message) *dbus.Error {
+	a.s.called("Session.Close")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	path := fakeSecretsPath(msg)
+	if _, ok := a.s.sessions[path]; !ok {
+		return errFakeSecretsNoSuchObject
+	}
+	delete(a.s.sessions, path)
+
+	return nil
+}
+
+type fakeSecretsPromptAPI struct{ s *fakeSecretService }
+
+func (a fakeSecretsPromptAPI) Prompt(msg dbus.Message, windowID string) *dbus.Error {
+	a.s.called("Prompt")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	path := fakeSecretsPath(msg)
+	action, ok := a.s.prompts[path]
+	if !ok {
+		return errFakeSecretsNoSuchObject
+	}
+
+	if a.s.IgnorePrompts {
+		return nil
+	}
+	delete(a.s.prompts, path)
+
+	dismissed, result := a.s.DismissPrompts, dbus.MakeVariant("")
+	if !dismissed {
+		result = action()
+	}
+
+	// The user answers after the call returns
+	go func() {
+		_ = a.s.conn.Emit(path, secretsInterfacePrompt+".Completed", dismissed, result)
+	}()
+
+	return nil
+}
+
+func (a fakeSecretsPromptAPI) Dismiss(msg dbus.Message) *dbus.Error {
+	a.s.called("Dismiss")
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	path := fakeSecretsPath(msg)
+	if _, ok := a.s.prompts[path]; !ok {
+		return errFakeSecretsNoSuchObject
+	}
+	delete(a.s.prompts, path)
+
+	go func() {
+		_ = a.s.conn.Emit(path, secretsInterfacePrompt+".Completed", true, dbus.MakeVariant(""))
+	}()
+
+	return nil
+}
+
+type fakeSecretsPropertiesAPI struct{ s *fakeSecretService }
+
+func (a fakeSecretsPropertiesAPI) Get(msg dbus.Message, iface, name string) (dbus.Variant, *dbus.Error) {
+	a.s.called("Get")
+
+	props, err := a.properties(fakeSecretsPath(msg), iface)
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+
+	value, ok := props[name]
+	if !ok {
+		return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", []interface{}{name})
+	}
+
+	return value, nil
+}
+
+func (a fakeSecretsPropertiesAPI) GetAll(msg dbus.Message, iface string) (map[string]dbus.Variant, *dbus.Error) {
+	a.s.called("GetAll")
+
+	return a.properties(fakeSecretsPath(msg), iface)
+}
+
+func (a fakeSecretsPropertiesAPI) properties(path dbus.ObjectPath, iface string) (map[string]dbus.Variant, *dbus.Error) {
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+
+	if path == secretsServicePath && iface == secretsInterfaceService {
+		collections := []dbus.ObjectPath{}
+		for p := range a.s.collections {
+			collections = append(collections, p)
+		}
+		return map[string]dbus.Variant{"Collections": dbus.MakeVariant(collections)}, nil
+	}
+
+	c, item, err := a.s.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil && iface == secretsInterfaceCollection {
+		items := []dbus.ObjectPath{}
+		for p := range c.items {
+			items = append(items, p)
+		}
+		return map[string]dbus.Variant{
+			"Items":    dbus.MakeVariant(items),
+			"Label":    dbus.MakeVariant(c.label),
+			"Locked":   dbus.MakeVariant(c.locked),
+			"Created":  dbus.MakeVariant(c.created),
+			"Modified": dbus.MakeVariant(c.modified),
+		}, nil
+	}
+
+	if item != nil && iface == secretsInterfaceItem {
+		if a.s.FailProperties {
+			return nil, dbus.MakeFailedError(fmt.Errorf("properties of %s are unavailable", path))
+		}
+		return map[string]dbus.Variant{
+			"Locked":     dbus.MakeVariant(c.locked),
+			"Attributes": dbus.MakeVariant(item.attributes),
+			"Label":      dbus.MakeVariant(item.label),
+			"Created":    dbus.MakeVariant(item.created),
+			"Modified":   dbus.MakeVariant(item.modified),
+		}, nil
+	}
+
+	return nil, dbus.NewError("org.freedesktop.DBus.Error.UnknownInterface", []interface{}{iface})
+}
@@ -0,0 +1,177 @@
+//go:build linux
+// +build linux
+
+package keyring
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/godbus/dbus"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Algorithms for the transport of secrets between us and the Secret Service,
+// see https://specifications.freedesktop.org/secret-service/latest/ch07.html
+const (
+	secretsAlgorithmPlain = "plain"
+	secretsAlgorithmDH    = "dh-ietf1024-sha256-aes128-cbc-pkcs7"
+)
+
+// secretsDHPrime is the 1024-bit MODP group from RFC 2409 section 6.2, whose
+// generator is 2.
+var secretsDHPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+var secretsDHGenerator = big.NewInt(2)
+
+// secretsSession is an open session with the Secret Service. Secrets are
+// encrypted with key, or sent as they are if it's nil.
+type secretsSession struct {
+	path dbus.ObjectPath
+	key  []byte
+}
+
+// openSecretsSession negotiates an encrypted session, falling back to a plain
+// one only if allowPlain is set.
+func openSecretsSession(service *secretsBinding, allowPlain bool) (*secretsSession, error) {
+	session, err := openSecretsDHSession(service)
+	if err == nil {
+		return session, nil
+	}
+
+	if !secretsIsError(err, "org.freedesktop.DBus.Error.NotSupported") {
+		return nil, err
+	}
+	if !allowPlain {
+		return nil, fmt.Errorf("The Secret Service doesn't support encrypted sessions and plain sessions aren't allowed: %w", err)
+	}
+
+	debugf("Secret Service doesn't support %s, falling back to a plain session", secretsAlgorithmDH)
+	_, path, err := service.OpenSession(secretsAlgorithmPlain, dbus.MakeVariant(""))
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretsSession{path: path}, nil
+}
+
+func openSecretsDHSession(service *secretsBinding) (*secretsSession, error) {
+	private, public, err := secretsDHKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	output, path, err := service.OpenSession(secretsAlgorithmDH, dbus.MakeVariant(public))
+	if err != nil {
+		return nil, err
+	}
+
+	serverPublic, ok := output.Value().([]byte)
+	if !ok {
+		return nil, errors.New("Unexpected output from opening an encrypted Secret Service session")
+	}
+
+	key, err := secretsDHKey(private, serverPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretsSession{path: path, key: key}, nil
+}
+
+// secretsDHKeyPair generates our private and public Diffie-Hellman values.
+func secretsDHKeyPair() (*big.Int, []byte, error) {
+	private, err := rand.Int(rand.Reader, new(big.Int).Sub(secretsDHPrime, big.NewInt(2)))
+	if err != nil {
+		return nil, nil, err
+	}
+	private.Add(private, big.NewInt(1))
+
+	public := new(big.Int).Exp(secretsDHGenerator, private, secretsDHPrime)
+	return private, public.Bytes(), nil
+}
+
+// secretsDHKey derives the AES key from the shared Diffie-Hellman secret.
+func secretsDHKey(private *big.Int, otherPublic []byte) ([]byte, error) {
+	other := new(big.Int).SetBytes(otherPublic)
+	if other.Cmp(big.NewInt(1)) <= 0 || other.Cmp(new(big.Int).Sub(secretsDHPrime, big.NewInt(1))) >= 0 {
+		return nil, errors.New("Invalid public key from the Secret Service")
+	}
+
+	shared := new(big.Int).Exp(other, private, secretsDHPrime)
+
+	// The shared secret is left padded to the size of the prime
+	ikm := make([]byte, (secretsDHPrime.BitLen()+7)/8)
+	shared.FillBytes(ikm)
+
+	key := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, nil, nil), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// encrypt returns the parameters and value of a secret to send.
+func (s *secretsSession) encrypt(plaintext []byte) ([]byte, []byte, error) {
+	if s.key == nil {
+		return []byte{}, plaintext, nil
+	}
+
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, err
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	return iv, ciphertext, nil
+}
+
+// decrypt returns the plaintext of a received secret.
+func (s *secretsSession) decrypt(parameters, value []byte) ([]byte, error) {
+	if s.key == nil {
+		return value, nil
+	}
+
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parameters) != aes.BlockSize || len(value) == 0 || len(value)%aes.BlockSize != 0 {
+		return nil, errors.New("Malformed encrypted secret from the Secret Service")
+	}
+
+	plaintext := make([]byte, len(value))
+	cipher.NewCBCDecrypter(block, parameters).CryptBlocks(plaintext, value)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("Malformed padding of encrypted secret from the Secret Service")
+	}
+
+	return plaintext[:len(plaintext)-padding], nil
+}
@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package keyring
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecretsDHKeyAgreement(t *testing.T) {
+	clientPrivate, clientPublic, err := secretsDHKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPrivate, serverPublic, err := secretsDHKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := secretsDHKey(clientPrivate, serverPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := secretsDHKey(serverPrivate, clientPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientKey, serverKey) || len(clientKey) != 16 {
+		t.Fatalf("Expected matching 16 byte keys, got %x and %x", clientKey, serverKey)
+	}
+
+	if _, err := secretsDHKey(clientPrivate, []byte{1}); err == nil {
+		t.Fatal("Expected an error for a degenerate public key")
+	}
+}
+
+func TestSecretsSessionEncryption(t *testing.T) {
+	session := &secretsSession{key: bytes.Repeat([]byte{0x42}, 16)}
+
+	for _, plaintext := range [][]byte{{}, []byte("llamas are great"), bytes.Repeat([]byte("a"), 100)} {
+		parameters, value, err := session.encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(value, plaintext) && len(plaintext) > 0 {
+			t.Fatal("Expected the secret to be encrypted")
+		}
+
+		decrypted, err := session.decrypt(parameters, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("Expected %q, got %q", plaintext, decrypted)
+		}
+	}
+
+	parameters, value, err := session.encrypt([]byte("llamas are great"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value[len(value)-1] ^= 0xff
+	if _, err := session.decrypt(parameters, value); err == nil {
+		t.Fatal("Expected an error for a corrupted secret")
+	}
+}
@@ -93,6 +93,11 @@ func (k *windowsKeyring) Keys() ([]string, error) {
 	return results, nil
 }
 
+// Close does nothing, the Credential Manager holds no resources between calls.
+func (k *windowsKeyring) Close() error {
+	return nil
+}
+
 func (k *windowsKeyring) credentialName(key string) string {
 	return k.prefix + ":" + k.name + ":" + key
 }